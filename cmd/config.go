@@ -0,0 +1,515 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the environment variable of every option, eg. TORPROXY_TLS_POLICY for --tls-policy
+const envPrefix = "TORPROXY_"
+
+// configSections groups the options in the configuration file, the keys of each section are the flag names
+// options can also be given at the top level of the file
+var configSections = []struct {
+	name  string
+	flags []string
+}{
+	{"registry", []string{"registry", "auto-update-period"}},
+	{"listeners", []string{"port", "insecure", "tls-port", "listen-plaintext", "listen-unix", "http-port", "http3", "proxy-protocol-trusted-cidr", "access-log", "admin-address", "shutdown-timeout", "shutdown-delay"}},
+	{"tls", []string{"domain", "on-demand-tls", "on-demand-allowed-domain", "email", "tls-storage-dir", "acme-ca", "acme-ca-root", "acme-eab-key-id", "acme-eab-mac-key", "dns-rfc2136-server", "dns-tsig-key-name", "dns-tsig-secret", "dns-tsig-algorithm", "tls-cert-path", "tls-key-path", "tls-cert-watch-period", "tls-policy", "tls-min-version", "tls-max-version", "tls-cipher", "tls-curve", "tls-alpn", "client-ca", "client-auth"}},
+	{"tor", []string{"socks5-hostname", "socks5-port", "socks5-username", "socks5-password", "socks5-backend", "socks5-balancing", "socks5-health-check-period", "override", "direct", "tor-exe-path"}},
+	{"onion", []string{"onion-service", "onion-only", "onion-control-address", "onion-control-password", "onion-key-path", "onion-port", "onion-target-address"}},
+	{"routes", []string{"header-policy", "cors-allowed-origin", "cors-allowed-origin-regex", "cors-allowed-method", "cors-allowed-header", "cors-exposed-header", "cors-allow-credentials", "cors-max-age", "host-routing-domain", "host-routing-alias", "allowed-client", "route-allowed-client"}},
+}
+
+// routeFlags can also be given per route, in a map keyed by onion host in the routes section
+// they override the proxy-wide values for the requests to that onion
+var routeFlags = []string{"header-policy", "cors-allowed-origin", "cors-allowed-origin-regex", "cors-allowed-method", "cors-allowed-header", "cors-exposed-header", "cors-allow-credentials", "cors-max-age", "allowed-client"}
+
+// deprecatedEnvVars are the environment variables read by the envvars image before the TORPROXY_ ones, keyed by flag name
+// they are still read, after the TORPROXY_ variable of the flag
+var deprecatedEnvVars = map[string]string{
+	"port":            "PORT",
+	"registry":        "REGISTRY_URL",
+	"socks5-hostname": "SOCKS5_HOSTNAME",
+	"socks5-port":     "SOCKS5_PORT",
+}
+
+// secretFlags are redacted by config print
+var secretFlags = []string{"acme-eab-mac-key", "dns-tsig-secret", "socks5-password", "onion-control-password"}
+
+var configCmd = cli.Command{
+	Name:  "config",
+	Usage: "inspect the configuration of the start command",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "print",
+			Usage:  "print the effective configuration, merging the configuration file, the environment and the flags",
+			Flags:  start.Flags,
+			Action: configPrintAction,
+		},
+	},
+}
+
+// flagValues reads the options of the start command, either from a *cli.Context or a *config
+type flagValues interface {
+	String(name string) string
+	StringSlice(name string) []string
+	Bool(name string) bool
+	Int(name string) int
+	Duration(name string) time.Duration
+}
+
+// config merges the configuration file with the command line and the environment, which take precedence
+type config struct {
+	ctx *cli.Context
+	// file holds the values of the file keyed by flag name, typed as the flags
+	file map[string]interface{}
+	// routes holds the per-route values of the file, in the order of the file
+	routes []*routeConfig
+}
+
+// routeConfig holds the values of the file for a single route, keyed by flag name and typed as the flags
+type routeConfig struct {
+	host   string
+	values yaml.MapSlice
+}
+
+// loadConfig reads the configuration file given with --config, if any
+// it fails on unknown options and on values not matching the type of the flag
+func loadConfig(ctx *cli.Context) (*config, error) {
+	c := &config{ctx: ctx, file: make(map[string]interface{})}
+
+	path := ctx.String("config")
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	var raw yaml.MapSlice
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	flags := make(map[string]cli.Flag, len(ctx.Command.Flags))
+	for _, f := range ctx.Command.Flags {
+		flags[f.Names()[0]] = f
+	}
+
+	for _, item := range raw {
+		key := fmt.Sprint(item.Key)
+		// registry is both a section and an option, a scalar is the option
+		if section := sectionFlags(key); section != nil && (isMap(item.Value) || flags[key] == nil) {
+			values, ok := item.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, fmt.Errorf("config file %s: section %s must be a map", path, key)
+			}
+			for _, v := range values {
+				name := fmt.Sprint(v.Key)
+				if routeValues, ok := v.Value.(yaml.MapSlice); ok && key == "routes" && !containsString(section, name) {
+					route, err := parseRoute(name, routeValues, flags)
+					if err != nil {
+						return nil, fmt.Errorf("config file %s: %w", path, err)
+					}
+					c.routes = append(c.routes, route)
+					continue
+				}
+				if !containsString(section, name) {
+					return nil, fmt.Errorf("config file %s: unknown option %s.%s", path, key, name)
+				}
+				if err := c.set(flags[name], v.Value); err != nil {
+					return nil, fmt.Errorf("config file %s: %s.%s: %w", path, key, name, err)
+				}
+			}
+			continue
+		}
+
+		f, ok := flags[key]
+		if !ok || key == "config" {
+			return nil, fmt.Errorf("config file %s: unknown option %s", path, key)
+		}
+		if err := c.set(f, item.Value); err != nil {
+			return nil, fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+	}
+
+	return c, nil
+}
+
+// parseRoute reads the options of the route to the given onion host
+func parseRoute(host string, values yaml.MapSlice, flags map[string]cli.Flag) (*routeConfig, error) {
+	route := &routeConfig{host: host}
+	for _, v := range values {
+		name := fmt.Sprint(v.Key)
+		if !containsString(routeFlags, name) {
+			return nil, fmt.Errorf("unknown option routes.%s.%s", host, name)
+		}
+		value, err := typedValue(flags[name], v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("routes.%s.%s: %w", host, name, err)
+		}
+		route.values = append(route.values, yaml.MapItem{Key: name, Value: value})
+	}
+	return route, nil
+}
+
+// set converts the value of the file to the type of the flag
+func (c *config) set(f cli.Flag, value interface{}) error {
+	v, err := typedValue(f, value)
+	if err != nil {
+		return err
+	}
+	c.file[f.Names()[0]] = v
+	return nil
+}
+
+// typedValue converts a value of the file to the type of the flag
+func typedValue(f cli.Flag, value interface{}) (interface{}, error) {
+	switch f.(type) {
+	case *cli.StringFlag:
+		return scalar(value)
+	case *cli.StringSliceFlag:
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+		values := make([]string, 0, len(list))
+		for _, v := range list {
+			s, err := scalar(v)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	case *cli.BoolFlag:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a boolean, got %v", value)
+		}
+		return b, nil
+	case *cli.IntFlag:
+		i, ok := value.(int)
+		if !ok {
+			return nil, fmt.Errorf("expected an integer, got %v", value)
+		}
+		return i, nil
+	case *cli.DurationFlag:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a duration like 30s, got %v", value)
+		}
+		return time.ParseDuration(s)
+	default:
+		return nil, fmt.Errorf("unsupported option")
+	}
+}
+
+// scalar returns the string form of a YAML scalar, eg. 1.2 for a TLS version
+func scalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int, float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("expected a string, got %v", value)
+	}
+}
+
+// fromFile returns the value of the file for the option, unless it is given on the command line or in the environment
+func (c *config) fromFile(name string) (interface{}, bool) {
+	if c.ctx.IsSet(name) {
+		return nil, false
+	}
+	v, ok := c.file[name]
+	return v, ok
+}
+
+func (c *config) String(name string) string {
+	if v, ok := c.fromFile(name); ok {
+		return v.(string)
+	}
+	return c.ctx.String(name)
+}
+
+func (c *config) StringSlice(name string) []string {
+	if v, ok := c.fromFile(name); ok {
+		return v.([]string)
+	}
+	return c.ctx.StringSlice(name)
+}
+
+func (c *config) Bool(name string) bool {
+	if v, ok := c.fromFile(name); ok {
+		return v.(bool)
+	}
+	return c.ctx.Bool(name)
+}
+
+func (c *config) Int(name string) int {
+	if v, ok := c.fromFile(name); ok {
+		return v.(int)
+	}
+	return c.ctx.Int(name)
+}
+
+func (c *config) Duration(name string) time.Duration {
+	if v, ok := c.fromFile(name); ok {
+		return v.(time.Duration)
+	}
+	return c.ctx.Duration(name)
+}
+
+// flagValues returns the options of the route, falling back to the proxy-wide ones
+func (r *routeConfig) flagValues(base flagValues) flagValues {
+	return &routeValues{flagValues: base, route: r}
+}
+
+// value returns the value of the route for the option, if any
+func (r *routeConfig) value(name string) (interface{}, bool) {
+	for _, v := range r.values {
+		if v.Key == name {
+			return v.Value, true
+		}
+	}
+	return nil, false
+}
+
+// has returns true if any of the given options is set for the route
+func (r *routeConfig) has(names ...string) bool {
+	for _, name := range names {
+		if _, ok := r.value(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// routeValues reads the options of a route, the proxy-wide ones apply to those not set
+type routeValues struct {
+	flagValues
+	route *routeConfig
+}
+
+func (r *routeValues) String(name string) string {
+	if v, ok := r.route.value(name); ok {
+		return v.(string)
+	}
+	return r.flagValues.String(name)
+}
+
+func (r *routeValues) StringSlice(name string) []string {
+	if v, ok := r.route.value(name); ok {
+		return v.([]string)
+	}
+	return r.flagValues.StringSlice(name)
+}
+
+func (r *routeValues) Bool(name string) bool {
+	if v, ok := r.route.value(name); ok {
+		return v.(bool)
+	}
+	return r.flagValues.Bool(name)
+}
+
+func (r *routeValues) Int(name string) int {
+	if v, ok := r.route.value(name); ok {
+		return v.(int)
+	}
+	return r.flagValues.Int(name)
+}
+
+func (r *routeValues) Duration(name string) time.Duration {
+	if v, ok := r.route.value(name); ok {
+		return v.(time.Duration)
+	}
+	return r.flagValues.Duration(name)
+}
+
+// configPrintAction prints the effective configuration as a configuration file, with the secrets redacted
+func configPrintAction(ctx *cli.Context) error {
+	c, err := loadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	flags := make(map[string]cli.Flag, len(ctx.Command.Flags))
+	for _, f := range ctx.Command.Flags {
+		flags[f.Names()[0]] = f
+	}
+
+	out := make(yaml.MapSlice, 0, len(configSections))
+	for _, section := range configSections {
+		values := make(yaml.MapSlice, 0, len(section.flags))
+		for _, name := range section.flags {
+			values = append(values, yaml.MapItem{Key: name, Value: c.value(flags[name])})
+		}
+		if section.name == "routes" {
+			for _, route := range c.routes {
+				values = append(values, yaml.MapItem{Key: route.host, Value: route.printable()})
+			}
+		}
+		out = append(out, yaml.MapItem{Key: section.name, Value: values})
+	}
+
+	data, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = ctx.App.Writer.Write(data)
+	return err
+}
+
+// value returns the effective value of the flag, for printing
+func (c *config) value(f cli.Flag) interface{} {
+	name := f.Names()[0]
+	value := c.rawValue(f)
+	if s, ok := value.(string); ok && s != "" && containsString(secretFlags, name) {
+		return "<redacted>"
+	}
+	return value
+}
+
+// rawValue returns the effective value of the flag, the durations as strings
+func (c *config) rawValue(f cli.Flag) interface{} {
+	name := f.Names()[0]
+
+	switch f.(type) {
+	case *cli.StringSliceFlag:
+		values := c.StringSlice(name)
+		if values == nil {
+			values = []string{}
+		}
+		return values
+	case *cli.BoolFlag:
+		return c.Bool(name)
+	case *cli.IntFlag:
+		return c.Int(name)
+	case *cli.DurationFlag:
+		return c.Duration(name).String()
+	default:
+		return c.String(name)
+	}
+}
+
+// changedRestartOptions lists the options differing in next which can't be reloaded, ie. outside of the routes section
+func (c *config) changedRestartOptions(next *config) []string {
+	flags := make(map[string]cli.Flag, len(c.ctx.Command.Flags))
+	for _, f := range c.ctx.Command.Flags {
+		flags[f.Names()[0]] = f
+	}
+
+	var changed []string
+	for _, section := range configSections {
+		if section.name == "routes" {
+			continue
+		}
+		for _, name := range section.flags {
+			// the registry is fetched again on reload
+			if name == "registry" {
+				continue
+			}
+			if !reflect.DeepEqual(c.rawValue(flags[name]), next.rawValue(flags[name])) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	return changed
+}
+
+// printable returns the values of the route as written in a configuration file
+func (r *routeConfig) printable() yaml.MapSlice {
+	values := make(yaml.MapSlice, 0, len(r.values))
+	for _, v := range r.values {
+		if d, ok := v.Value.(time.Duration); ok {
+			v.Value = d.String()
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// withEnvVars adds the TORPROXY_ prefixed environment variable of every flag, after the ones already given
+// and followed by its deprecated name, if any
+func withEnvVars(flags []cli.Flag) []cli.Flag {
+	for _, f := range flags {
+		env := []string{envVar(f.Names()[0])}
+		if deprecated, ok := deprecatedEnvVars[f.Names()[0]]; ok {
+			env = append(env, deprecated)
+		}
+		switch flag := f.(type) {
+		case *cli.StringFlag:
+			flag.EnvVars = append(flag.EnvVars, env...)
+		case *cli.StringSliceFlag:
+			flag.EnvVars = append(flag.EnvVars, env...)
+		case *cli.BoolFlag:
+			flag.EnvVars = append(flag.EnvVars, env...)
+		case *cli.IntFlag:
+			flag.EnvVars = append(flag.EnvVars, env...)
+		case *cli.DurationFlag:
+			flag.EnvVars = append(flag.EnvVars, env...)
+		}
+	}
+	return flags
+}
+
+// envVar returns the TORPROXY_ prefixed environment variable of the flag
+func envVar(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// deprecatedEnvVarsInUse lists the deprecated environment variables set, along with the variable replacing them
+func deprecatedEnvVarsInUse() []string {
+	var inUse []string
+	for _, name := range sortedKeys(deprecatedEnvVars) {
+		if _, ok := os.LookupEnv(deprecatedEnvVars[name]); ok {
+			inUse = append(inUse, fmt.Sprintf("%s is deprecated, use %s", deprecatedEnvVars[name], envVar(name)))
+		}
+	}
+	return inUse
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isMap(value interface{}) bool {
+	_, ok := value.(yaml.MapSlice)
+	return ok
+}
+
+func sectionFlags(name string) []string {
+	for _, section := range configSections {
+		if section.name == name {
+			return section.flags
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
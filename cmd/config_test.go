@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// withConfigFile writes the configuration file in a temporary directory and returns its path
+func withConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "torproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "torproxy.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withEnv sets the environment variables for the duration of the test
+func withEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	for k, v := range env {
+		previous, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, previous)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+// runStart parses the arguments with the flags of the start command and returns the merged configuration
+func runStart(t *testing.T, args ...string) *config {
+	t.Helper()
+
+	var c *config
+	app := &cli.App{
+		Commands: []*cli.Command{{
+			Name:  "start",
+			Flags: startFlags(),
+			Action: func(ctx *cli.Context) error {
+				var err error
+				c, err = loadConfig(ctx)
+				return err
+			},
+		}},
+	}
+	if err := app.Run(append([]string{"torproxy", "start"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := withConfigFile(t, `
+listeners:
+  port: 7001
+tls:
+  tls-policy: modern
+routes:
+  allowed-client: [file.example.com]
+`)
+
+	tests := []struct {
+		name           string
+		args           []string
+		env            map[string]string
+		port           int
+		tlsPolicy      string
+		allowedClients []string
+	}{
+		{
+			name:      "defaults",
+			port:      7070,
+			tlsPolicy: "intermediate",
+		},
+		{
+			name:           "file",
+			args:           []string{"--config", file},
+			port:           7001,
+			tlsPolicy:      "modern",
+			allowedClients: []string{"file.example.com"},
+		},
+		{
+			name:           "environment over file",
+			args:           []string{"--config", file},
+			env:            map[string]string{"TORPROXY_PORT": "7002", "TORPROXY_ALLOWED_CLIENT": "env.example.com"},
+			port:           7002,
+			tlsPolicy:      "modern",
+			allowedClients: []string{"env.example.com"},
+		},
+		{
+			name:           "flags over environment",
+			args:           []string{"--config", file, "--port", "7003", "--tls-policy", "intermediate"},
+			env:            map[string]string{"TORPROXY_PORT": "7002", "TORPROXY_TLS_POLICY": "modern"},
+			port:           7003,
+			tlsPolicy:      "intermediate",
+			allowedClients: []string{"file.example.com"},
+		},
+		{
+			name:           "configuration file from the environment",
+			env:            map[string]string{"TORPROXY_CONFIG": file},
+			port:           7001,
+			tlsPolicy:      "modern",
+			allowedClients: []string{"file.example.com"},
+		},
+		{
+			name:      "deprecated environment variable",
+			env:       map[string]string{"PORT": "7004"},
+			port:      7004,
+			tlsPolicy: "intermediate",
+		},
+		{
+			name:      "environment over deprecated environment variable",
+			env:       map[string]string{"PORT": "7004", "TORPROXY_PORT": "7005"},
+			port:      7005,
+			tlsPolicy: "intermediate",
+		},
+		{
+			name:           "deprecated environment variable over file",
+			args:           []string{"--config", file},
+			env:            map[string]string{"PORT": "7004"},
+			port:           7004,
+			tlsPolicy:      "modern",
+			allowedClients: []string{"file.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEnv(t, tt.env)
+			c := runStart(t, tt.args...)
+
+			if port := c.Int("port"); port != tt.port {
+				t.Errorf("got port %d, want %d", port, tt.port)
+			}
+			if policy := c.String("tls-policy"); policy != tt.tlsPolicy {
+				t.Errorf("got TLS policy %q, want %q", policy, tt.tlsPolicy)
+			}
+			if clients := c.StringSlice("allowed-client"); strings.Join(clients, ",") != strings.Join(tt.allowedClients, ",") {
+				t.Errorf("got allowed clients %q, want %q", clients, tt.allowedClients)
+			}
+		})
+	}
+}
+
+func TestDeprecatedEnvVars(t *testing.T) {
+	withEnv(t, map[string]string{
+		"REGISTRY_URL":    "./registry.json",
+		"SOCKS5_HOSTNAME": "tor",
+		"SOCKS5_PORT":     "9150",
+	})
+	c := runStart(t)
+
+	if registry := c.String("registry"); registry != "./registry.json" {
+		t.Errorf("got registry %q, want the one of REGISTRY_URL", registry)
+	}
+	if host := c.String("socks5-hostname"); host != "tor" {
+		t.Errorf("got socks5 hostname %q, want the one of SOCKS5_HOSTNAME", host)
+	}
+	if port := c.Int("socks5-port"); port != 9150 {
+		t.Errorf("got socks5 port %d, want the one of SOCKS5_PORT", port)
+	}
+
+	want := []string{
+		"REGISTRY_URL is deprecated, use TORPROXY_REGISTRY",
+		"SOCKS5_HOSTNAME is deprecated, use TORPROXY_SOCKS5_HOSTNAME",
+		"SOCKS5_PORT is deprecated, use TORPROXY_SOCKS5_PORT",
+	}
+	if got := deprecatedEnvVarsInUse(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got deprecation warnings %q, want %q", got, want)
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	file := withConfigFile(t, `
+tor:
+  socks5-username: alice
+  socks5-password: file-secret
+`)
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		secret string
+		// printed lists the expected values of the secret options, keyed by section then option
+		printed map[string]map[string]string
+	}{
+		{
+			name:   "file",
+			args:   []string{"--config", file},
+			secret: "file-secret",
+			printed: map[string]map[string]string{
+				"tor":   {"socks5-username": "alice", "socks5-password": "<redacted>"},
+				"onion": {"onion-control-password": ""},
+			},
+		},
+		{
+			name:   "environment",
+			env:    map[string]string{"TORPROXY_DNS_TSIG_SECRET": "env-secret"},
+			secret: "env-secret",
+			printed: map[string]map[string]string{
+				"tls": {"dns-tsig-secret": "<redacted>", "acme-eab-mac-key": ""},
+			},
+		},
+		{
+			name:   "environment variable of the flag",
+			env:    map[string]string{"ACME_EAB_MAC_KEY": "mac-secret"},
+			secret: "mac-secret",
+			printed: map[string]map[string]string{
+				"tls": {"acme-eab-mac-key": "<redacted>", "dns-tsig-secret": ""},
+			},
+		},
+		{
+			name:   "flag",
+			args:   []string{"--onion-control-password", "flag-secret"},
+			secret: "flag-secret",
+			printed: map[string]map[string]string{
+				"onion": {"onion-control-password": "<redacted>"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEnv(t, tt.env)
+
+			var out bytes.Buffer
+			app := &cli.App{
+				Writer: &out,
+				Commands: []*cli.Command{{
+					Name:   "print",
+					Flags:  startFlags(),
+					Action: configPrintAction,
+				}},
+			}
+			if err := app.Run(append([]string{"torproxy", "print"}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(out.String(), tt.secret) {
+				t.Fatalf("got the secret in the printed configuration:\n%s", out.String())
+			}
+			var printed map[string]map[string]interface{}
+			if err := yaml.Unmarshal(out.Bytes(), &printed); err != nil {
+				t.Fatal(err)
+			}
+			for section, values := range tt.printed {
+				for name, want := range values {
+					if got := printed[section][name]; got != want {
+						t.Errorf("%s.%s: got %v, want %q", section, name, got, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -17,6 +17,7 @@ func main() {
 	app.Commands = append(
 		app.Commands,
 		&start,
+		&configCmd,
 	)
 
 	err := app.Run(os.Args)
@@ -1,37 +1,104 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/caddyserver/certmagic"
 	registrypkg "github.com/tdex-network/tor-proxy/pkg/registry"
 	"github.com/tdex-network/tor-proxy/pkg/torproxy"
 	"github.com/urfave/cli/v2"
 	"github.com/weppos/publicsuffix-go/publicsuffix"
 )
 
+var defaultOnionKeyPath = filepath.Join(defaultDataDir(), "onion_v3.key")
+
 var start = cli.Command{
-	Name:  "start",
-	Usage: "start the reverse proxy",
-	Flags: []cli.Flag{
+	Name:   "start",
+	Usage:  "start the reverse proxy",
+	Flags:  startFlags(),
+	Action: startAction,
+}
+
+// startFlags returns the flags of the start command
+// cli sets the values read from the environment on the flags, a command run more than once needs its own
+func startFlags() []cli.Flag {
+	return withEnvVars([]cli.Flag{
 		&cli.StringFlag{
-			Name:     "registry",
-			Usage:    "JSON file or string with list of onion endpoints. For more info see https://github.com/TDex-network/tdex-registry",
-			Required: true,
+			Name:  "config",
+			Usage: "YAML configuration file, the keys are the flag names, optionally grouped in sections. Flags and environment variables take precedence",
 		},
 		&cli.StringFlag{
+			Name:  "registry",
+			Usage: "JSON file or string with list of onion endpoints, required. For more info see https://github.com/TDex-network/tdex-registry",
+		},
+		&cli.StringSliceFlag{
 			Name:  "domain",
-			Usage: "TLD domain to obtain and renew the SSL certificate expose the reverse proxy",
+			Usage: "TLD domain to obtain and renew the SSL certificate expose the reverse proxy. Repeat for several domains, wildcards like *.example.com are supported",
+		},
+		&cli.BoolFlag{
+			Name:  "on-demand-tls",
+			Usage: "obtain the certificates at the first TLS handshake of each allowed domain",
+		},
+		&cli.StringSliceFlag{
+			Name:  "on-demand-allowed-domain",
+			Usage: "with on demand TLS, domain allowed to obtain a certificate in addition to --domain. Repeat for several domains, wildcards like *.example.com are supported",
 		},
 		&cli.StringFlag{
 			Name:  "email",
 			Usage: "email address to signify agreement and to be notified in case of issues with SSL certificate",
 		},
+		&cli.StringFlag{
+			Name:  "tls-storage-dir",
+			Usage: "directory storing the certificates and ACME accounts, may be shared by several replicas. $HOME/.local/share/certmagic if not given",
+		},
+		&cli.StringFlag{
+			Name:  "acme-ca",
+			Usage: "ACME directory URL, eg. ZeroSSL, an internal step-ca or a local Pebble. Let's Encrypt if not given",
+		},
+		&cli.StringFlag{
+			Name:  "acme-ca-root",
+			Usage: "path of the PEM bundle of the roots trusted to connect to the ACME directory, the system roots if not given",
+		},
+		&cli.StringFlag{
+			Name:  "acme-eab-key-id",
+			Usage: "key identifier of the External Account Binding required by some CAs, eg. ZeroSSL",
+		},
+		&cli.StringFlag{
+			Name:    "acme-eab-mac-key",
+			Usage:   "base64url encoded HMAC key of the External Account Binding",
+			EnvVars: []string{"ACME_EAB_MAC_KEY"},
+		},
+		&cli.StringFlag{
+			Name:  "dns-rfc2136-server",
+			Usage: "host:port of the DNS server accepting RFC 2136 dynamic updates, solves DNS-01 challenges instead of HTTP-01 and TLS-ALPN-01",
+		},
+		&cli.StringFlag{
+			Name:  "dns-tsig-key-name",
+			Usage: "name of the TSIG key signing the DNS updates",
+		},
+		&cli.StringFlag{
+			Name:    "dns-tsig-secret",
+			Usage:   "base64 encoded secret of the TSIG key",
+			EnvVars: []string{"DNS_TSIG_SECRET"},
+		},
+		&cli.StringFlag{
+			Name:  "dns-tsig-algorithm",
+			Usage: "algorithm of the TSIG key",
+			Value: "hmac-sha256",
+		},
 		&cli.StringFlag{
 			Name:  "tls-cert-path",
 			Usage: "path of the the TLS certificate",
@@ -40,16 +107,106 @@ var start = cli.Command{
 			Name:  "tls-key-path",
 			Usage: "path of the the TLS key",
 		},
+		&cli.StringFlag{
+			Name:  "tls-policy",
+			Usage: "TLS preset: intermediate (TLS 1.2+) or modern (TLS 1.3 only)",
+			Value: "intermediate",
+		},
+		&cli.StringFlag{
+			Name:  "tls-min-version",
+			Usage: "minimum TLS version, eg. 1.2, overrides the preset",
+		},
+		&cli.StringFlag{
+			Name:  "tls-max-version",
+			Usage: "maximum TLS version, eg. 1.3, overrides the preset",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tls-cipher",
+			Usage: "TLS 1.2 cipher suite, eg. TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, overrides the preset. Repeat for several suites",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tls-curve",
+			Usage: "elliptic curve among X25519, P256, P384 and P521 in order of preference, overrides the preset. Repeat for several curves",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tls-alpn",
+			Usage: "ALPN protocol, eg. h2 or http/1.1 in order of preference, overrides the preset. Repeat for several protocols",
+		},
+		&cli.StringFlag{
+			Name:  "client-ca",
+			Usage: "path of the PEM bundle of the CAs issuing the client certificates, enables mutual TLS",
+		},
+		&cli.StringFlag{
+			Name:  "client-auth",
+			Usage: "client certificate verification with --client-ca: required or optional",
+			Value: "required",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allowed-client",
+			Usage: "subject (common name, DNS or email name) of the client certificates allowed on every route, wildcards like *.example.com are supported. Repeat for several subjects",
+		},
+		&cli.StringSliceFlag{
+			Name:  "route-allowed-client",
+			Usage: "<onion_host>=<subject> allow the client certificate subject on the route to the onion only, overriding --allowed-client. Repeat for several subjects",
+		},
+		&cli.BoolFlag{
+			Name:  "access-log",
+			Usage: "log every request with the identity of the verified client",
+		},
+		&cli.DurationFlag{
+			Name:  "tls-cert-watch-period",
+			Usage: "how often the TLS key and certificate files are checked for changes, they are also reloaded on SIGHUP",
+			Value: torproxy.DefaultCertificateWatchPeriod,
+		},
 		&cli.BoolFlag{
 			Name:  "insecure",
 			Usage: "expose in plaintext in localhost",
 			Value: false,
 		},
+		&cli.IntFlag{
+			Name:  "tls-port",
+			Usage: "listening port for the reverse proxy with TLS",
+			Value: 443,
+		},
+		&cli.BoolFlag{
+			Name:  "http3",
+			Usage: "serve HTTP/3 (QUIC) on the UDP port of --tls-port too, requires a binary built with -tags http3",
+		},
+		&cli.StringSliceFlag{
+			Name:  "proxy-protocol-trusted-cidr",
+			Usage: "enable PROXY protocol v1/v2 on the --port or --tls-port listener, trusting the headers sent from the given IP or CIDR, eg. of the load balancer. Repeat for several ranges",
+		},
+		&cli.StringSliceFlag{
+			Name:  "listen-plaintext",
+			Usage: "additional plaintext listening address, eg. 127.0.0.1:7070 for sidecar clients. Repeat for several addresses",
+		},
+		&cli.StringSliceFlag{
+			Name:  "listen-unix",
+			Usage: "additional plaintext unix domain socket path. Repeat for several sockets",
+		},
+		&cli.IntFlag{
+			Name:  "http-port",
+			Usage: "with TLS, listening port answering ACME HTTP-01 challenges and redirecting to HTTPS. 0 to disable",
+			Value: 80,
+		},
 		&cli.IntFlag{
 			Name:  "port",
 			Usage: "listening port for the reverse proxy",
 			Value: 7070,
 		},
+		&cli.StringFlag{
+			Name:  "admin-address",
+			Usage: "address of the admin listener serving the Prometheus metrics on " + torproxy.MetricsPath + " and the readiness on " + torproxy.ReadinessPath + ", eg. 127.0.0.1:9090. Disabled if empty",
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Usage: "on SIGTERM or SIGINT, how long the in-flight requests and gRPC streams are waited for before closing them",
+			Value: 30 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-delay",
+			Usage: "on SIGTERM or SIGINT, how long the proxy keeps accepting requests while answering 503 on " + torproxy.ReadinessPath + " of the admin listener, to let the load balancers notice",
+		},
 		&cli.StringFlag{
 			Name:  "socks5-hostname",
 			Usage: "the socks5 hostname exposed by the tor client",
@@ -60,37 +217,166 @@ var start = cli.Command{
 			Usage: "the socks5 port exposed by the tor client",
 			Value: 9050,
 		},
+		&cli.StringFlag{
+			Name:    "socks5-username",
+			Usage:   "username to authenticate to the socks5 proxy",
+			EnvVars: []string{"SOCKS5_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "socks5-password",
+			Usage:   "password to authenticate to the socks5 proxy",
+			EnvVars: []string{"SOCKS5_PASSWORD"},
+		},
+		&cli.StringSliceFlag{
+			Name:  "socks5-backend",
+			Usage: "host:port of a socks5 interface exposed by a tor client, repeat to balance over several clients. Overrides --socks5-hostname and --socks5-port",
+		},
+		&cli.StringFlag{
+			Name:  "socks5-balancing",
+			Usage: "strategy to select the socks5 backend: round-robin or least-connections",
+			Value: "round-robin",
+		},
+		&cli.IntFlag{
+			Name:  "socks5-health-check-period",
+			Usage: "period in seconds to check the socks5 backends are answering handshakes, 0 disables the checks",
+			Value: 30,
+		},
+		&cli.StringFlag{
+			Name:  "header-policy",
+			Usage: "client headers forwarded to the onions: privacy (strip identifying headers), pseudonymous (privacy with a client IP pseudonym in Forwarded) or transparent",
+			Value: "privacy",
+		},
+		&cli.StringSliceFlag{
+			Name:  "cors-allowed-origin",
+			Usage: "origin allowed to call the proxy from a browser, repeat for several origins. Supports * and subdomain wildcards like https://*.example.com",
+			Value: cli.NewStringSlice("*"),
+		},
+		&cli.StringSliceFlag{
+			Name:  "cors-allowed-origin-regex",
+			Usage: "regular expression matching the whole allowed origin, eg. https://[a-z]+\\.example\\.com, repeat for several expressions",
+		},
+		&cli.StringSliceFlag{
+			Name:  "cors-allowed-method",
+			Usage: "method allowed in CORS requests, repeat for several methods",
+			Value: cli.NewStringSlice("POST", "GET", "OPTIONS", "PUT", "DELETE"),
+		},
+		&cli.StringSliceFlag{
+			Name:  "cors-allowed-header",
+			Usage: "request header allowed in CORS requests, repeat for several headers",
+			Value: cli.NewStringSlice("*"),
+		},
+		&cli.StringSliceFlag{
+			Name:  "cors-exposed-header",
+			Usage: "response header exposed to the browser, repeat for several headers",
+			Value: cli.NewStringSlice("grpc-status", "grpc-message"),
+		},
+		&cli.BoolFlag{
+			Name:  "cors-allow-credentials",
+			Usage: "allow credentialed CORS requests",
+		},
+		&cli.IntFlag{
+			Name:  "cors-max-age",
+			Usage: "seconds the browser can cache the preflight response, 0 to not send it",
+		},
+		&cli.StringSliceFlag{
+			Name:  "host-routing-domain",
+			Usage: "base domain to route <onion_or_alias>.<base_domain> to the onion at the root path. Repeat for several domains",
+		},
+		&cli.StringSliceFlag{
+			Name:  "host-routing-alias",
+			Usage: "<alias>=<onion_host> route <alias>.<base_domain> to the given onion. Repeat for several aliases",
+		},
+		&cli.StringSliceFlag{
+			Name:  "override",
+			Usage: "<onion_host>[:<port>]=<host>:<port> dial the given address instead of the onion through tor, repeat for several onions",
+		},
+		&cli.BoolFlag{
+			Name:  "direct",
+			Usage: "local-dev mode: do not use tor, only the onions given with --override are reachable",
+		},
+		&cli.BoolFlag{
+			Name:  "onion-service",
+			Usage: "publish the reverse proxy as a v3 onion service",
+		},
+		&cli.BoolFlag{
+			Name:  "onion-only",
+			Usage: "serve the reverse proxy on the onion service only, without TLS or plaintext listener",
+		},
+		&cli.StringFlag{
+			Name:  "onion-control-address",
+			Usage: "host:port of the control port of a running tor client to add the onion service to. If not given the tor executable of the PATH, or --tor-exe-path, is started",
+		},
+		&cli.StringFlag{
+			Name:    "onion-control-password",
+			Usage:   "password to authenticate to the tor control port",
+			EnvVars: []string{"TOR_CONTROL_PASSWORD"},
+		},
+		&cli.StringFlag{
+			Name:  "onion-key-path",
+			Usage: "path of the file persisting the onion service private key",
+			Value: defaultOnionKeyPath,
+		},
+		&cli.IntFlag{
+			Name:  "onion-port",
+			Usage: "virtual port of the onion service",
+			Value: 80,
+		},
+		&cli.StringFlag{
+			Name:  "onion-target-address",
+			Usage: "address the tor client forwards the onion traffic to, if the tor client does not run on the same host",
+		},
+		&cli.StringFlag{
+			Name:  "tor-exe-path",
+			Usage: "path of the tor executable started when no control address is given, tor is looked up in the PATH otherwise",
+		},
 		&cli.IntFlag{
 			Name:  "auto-update-period",
 			Usage: "period in hours to check for new endpoints",
 			Value: 12,
 		},
-	},
-	Action: startAction,
+	})
 }
 
-func startAction(ctx *cli.Context) error {
+func startAction(cliCtx *cli.Context) error {
+	// merge the configuration file with the flags
+	ctx, err := loadConfig(cliCtx)
+	if err != nil {
+		return err
+	}
+
+	for _, env := range deprecatedEnvVarsInUse() {
+		log.Printf("environment variable %s", env)
+	}
+
+	// the checks of the options applied at start only, run again on reload
+	if err := validateRestartOptions(ctx); err != nil {
+		return err
+	}
 
-	// use an external socks5 interface
-	proxy, err := torproxy.NewTorProxyFromHostAndPort(
-		ctx.String("socks5-hostname"),
-		ctx.Int("socks5-port"),
-	)
+	// load the registry and the routing settings
+	settings, err := settingsFromFlags(ctx)
 	if err != nil {
-		return fmt.Errorf("creating tor instance: %w", err)
+		return err
 	}
 
-	// create registry
-	registry, err := registrypkg.NewRegistry(ctx.String("registry"))
+	proxy, err := newTorProxyFromFlags(ctx)
 	if err != nil {
-		return fmt.Errorf("loading json: %w", err)
+		return err
 	}
 
-	// Add registry to the proxy
-	// this will init the set of redirects
-	// in case of remote registry (an URL): start auto-updater
-	proxy.WithRegistry(registry)
+	if ctx.Bool("access-log") {
+		proxy.AccessLog = log.New(os.Stdout, "[access] ", log.LstdFlags)
+	}
+	proxy.ShutdownDelay = ctx.Duration("shutdown-delay")
+	if ctx.String("admin-address") != "" {
+		proxy.WithMetrics()
+	}
+
+	if _, err := proxy.Reload(settings); err != nil {
+		return err
+	}
 
+	// in case of remote registry (an URL): start auto-updater
 	if proxy.Registry.RegistryType() == registrypkg.RemoteRegistryType {
 		errorHandler := func(err error) {
 			log.Println("registry auto update error: %w", err)
@@ -102,56 +388,521 @@ func startAction(ctx *cli.Context) error {
 		proxy.WithAutoUpdater(autoUpdatePeriod, errorHandler)
 	}
 
-	// check if insecure flag, otherwise either domain or key & cert paths MUST be present to serve with TLS
-	var address string
-	var tlsOptions *torproxy.TLSOptions
-	if ctx.Bool("insecure") {
-		address = ":" + fmt.Sprint(ctx.Int("port"))
+	if ctx.Bool("onion-service") || ctx.Bool("onion-only") {
+		if err := proxy.WithOnionService(&torproxy.OnionServiceOptions{
+			ControlAddress:  ctx.String("onion-control-address"),
+			ControlPassword: ctx.String("onion-control-password"),
+			ExePath:         ctx.String("tor-exe-path"),
+			DataDir:         filepath.Join(filepath.Dir(ctx.String("onion-key-path")), "tor"),
+			KeyPath:         ctx.String("onion-key-path"),
+			RemotePort:      ctx.Int("onion-port"),
+			TargetAddress:   ctx.String("onion-target-address"),
+		}); err != nil {
+			return fmt.Errorf("publishing onion service: %w", err)
+		}
+	}
+
+	listeners, err := listenersFromFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range listeners {
+		log.Printf("Serving tor proxy on %s\n", l.Address)
+	}
+
+	if address := ctx.String("admin-address"); address != "" {
+		if err := proxy.ListenAdmin(address); err != nil {
+			return fmt.Errorf("listening admin on %s: %w", address, err)
+		}
+		log.Printf("Serving metrics on %s%s\n", address, torproxy.MetricsPath)
+	}
+
+	// reload the registry, the routing settings of the configuration file and the TLS certificates on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			reload(cliCtx, proxy, ctx)
+		}
+	}()
+
+	// catch SIGTERM and SIGINT signals to shut down gracefully, a second signal aborts the draining
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- proxy.ServeListeners(listeners)
+	}()
+
+	var sig os.Signal
+	select {
+	case err := <-errChan:
+		proxy.Close()
+		if err != nil {
+			return fmt.Errorf("serving proxy: %w", err)
+		}
+		return nil
+	case sig = <-sigChan:
+	}
+
+	timeout := ctx.Duration("shutdown-timeout")
+	log.Printf("Received %s, shutting down, draining the requests for up to %s\n", sig, timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	if err := proxy.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down: %w", err)
+	}
+
+	fmt.Println("Shutdown")
+
+	return nil
+}
+
+// listenersFromFlags returns the listeners to serve on
+// check if onion-only or insecure flag, otherwise either domain or key & cert paths MUST be present to serve with TLS
+// plaintext and unix socket listeners can be added alongside
+func listenersFromFlags(ctx flagValues) ([]*torproxy.ListenerOptions, error) {
+	listeners := make([]*torproxy.ListenerOptions, 0)
+
+	if ctx.Bool("onion-only") {
+		// no TLS nor plaintext listener required
+	} else if ctx.Bool("insecure") {
+		listeners = append(listeners, &torproxy.ListenerOptions{
+			Address: ":" + fmt.Sprint(ctx.Int("port")),
+		})
 	} else {
 		email := ctx.String("email")
-		domain := ctx.String("domain")
+		domains := ctx.StringSlice("domain")
+		onDemand := ctx.Bool("on-demand-tls")
+		allowedDomains := ctx.StringSlice("on-demand-allowed-domain")
 		tlsKey := ctx.String("tls-key-path")
 		tlsCert := ctx.String("tls-cert-path")
 
 		if (tlsKey == "" && tlsCert != "") || (tlsKey != "" && tlsCert == "") {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"TLS requires both key and certificate when enabled",
 			)
 		}
 
-		// check if given domain is valid URL
-		if (len(domain) == 0 || !isValidDomain(domain)) && tlsKey == "" && tlsCert == "" {
-			return errors.New("either domain or certificate is required for TLS. Do you want to use --insecure?")
+		// check if given domains are valid
+		for _, d := range append(domains, allowedDomains...) {
+			if !isValidDomain(d) {
+				return nil, fmt.Errorf("invalid domain %s", d)
+			}
+		}
+		if len(domains) == 0 && !(onDemand && len(allowedDomains) > 0) && tlsKey == "" && tlsCert == "" {
+			return nil, errors.New("either domain or certificate is required for TLS. Do you want to use --insecure?")
+		}
+
+		policy, err := tlsPolicyFromFlags(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var caRoots *x509.CertPool
+		if path := ctx.String("acme-ca-root"); path != "" {
+			bundle, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading ACME CA roots: %w", err)
+			}
+			caRoots = x509.NewCertPool()
+			if !caRoots.AppendCertsFromPEM(bundle) {
+				return nil, fmt.Errorf("no certificate found in ACME CA roots %s", path)
+			}
+		}
+		if (ctx.String("acme-eab-key-id") == "") != (ctx.String("acme-eab-mac-key") == "") {
+			return nil, errors.New("External Account Binding requires both key id and MAC key")
 		}
 
-		address = ":443"
-		tlsOptions = &torproxy.TLSOptions{
-			Domains: []string{domain},
-			Email:   email,
-			TLSKey:  tlsKey,
-			TLSCert: tlsCert,
+		var dnsProvider certmagic.ACMEDNSProvider
+		if server := ctx.String("dns-rfc2136-server"); server != "" {
+			dnsProvider = &torproxy.RFC2136Provider{
+				Server:        server,
+				TSIGKeyName:   ctx.String("dns-tsig-key-name"),
+				TSIGSecret:    ctx.String("dns-tsig-secret"),
+				TSIGAlgorithm: ctx.String("dns-tsig-algorithm"),
+			}
 		}
+
+		var clientAuth *torproxy.ClientAuthOptions
+		if caFile := ctx.String("client-ca"); caFile != "" {
+			mode, err := torproxy.ParseClientAuthMode(ctx.String("client-auth"))
+			if err != nil {
+				return nil, err
+			}
+			clientAuth = &torproxy.ClientAuthOptions{Mode: mode, CAFile: caFile}
+		}
+
+		var httpAddress string
+		if httpPort := ctx.Int("http-port"); httpPort > 0 {
+			httpAddress = ":" + fmt.Sprint(httpPort)
+		}
+
+		listeners = append(listeners, &torproxy.ListenerOptions{
+			Address: ":" + fmt.Sprint(ctx.Int("tls-port")),
+			HTTP3:   ctx.Bool("http3"),
+			TLS: &torproxy.TLSOptions{
+				Domains:         domains,
+				Email:           email,
+				StorageDir:      ctx.String("tls-storage-dir"),
+				CA:              ctx.String("acme-ca"),
+				CARoots:         caRoots,
+				EABKeyID:        ctx.String("acme-eab-key-id"),
+				EABMACKey:       ctx.String("acme-eab-mac-key"),
+				DNSProvider:     dnsProvider,
+				TLSKey:          tlsKey,
+				TLSCert:         tlsCert,
+				HTTPAddress:     httpAddress,
+				OnDemand:        onDemand,
+				AllowedDomains:  allowedDomains,
+				Policy:          policy,
+				ClientAuth:      clientAuth,
+				CertWatchPeriod: ctx.Duration("tls-cert-watch-period"),
+			},
+		})
 	}
 
-	log.Printf("Serving tor proxy on %s\n", address)
+	// only the public listeners are behind the load balancer, the sidecar ones never read a PROXY header
+	if values := ctx.StringSlice("proxy-protocol-trusted-cidr"); len(values) > 0 {
+		cidrs, err := torproxy.ParseCIDRs(values)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range listeners {
+			l.ProxyProtocol = &torproxy.ProxyProtocolOptions{TrustedCIDRs: cidrs}
+		}
+	}
 
-	if err := proxy.Serve(address, tlsOptions); err != nil {
-		return fmt.Errorf("serving proxy: %w", err)
+	for _, address := range ctx.StringSlice("listen-plaintext") {
+		listeners = append(listeners, &torproxy.ListenerOptions{Address: address})
+	}
+	for _, path := range ctx.StringSlice("listen-unix") {
+		listeners = append(listeners, &torproxy.ListenerOptions{Network: "unix", Address: path})
 	}
-	// close the proxy when the process is interrupted
-	defer proxy.Close() // close the auto-updater in case of remote registry
 
-	// Catch SIGTERM and SIGINT signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
-	<-sigChan
+	return listeners, nil
+}
 
-	fmt.Println("Shutdown")
+func newTorProxyFromFlags(ctx flagValues) (*torproxy.TorProxy, error) {
+	overrides, err := torproxy.ParseOverrides(ctx.StringSlice("override"))
+	if err != nil {
+		return nil, err
+	}
+
+	// local-dev mode: only overridden onions are reachable, no socks5 proxy involved
+	if ctx.Bool("direct") {
+		if len(overrides) == 0 {
+			return nil, errors.New("direct mode requires at least one --override")
+		}
+		log.Println("direct mode: dialing overridden onions without tor")
+		return torproxy.NewTorProxyWithDialer(&torproxy.OverrideDialer{Overrides: overrides}), nil
+	}
+
+	// use one or more external socks5 interfaces
+	clients, err := torClientsFromFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	strategy, err := torproxy.ParseBalancingStrategy(ctx.String("socks5-balancing"))
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := torproxy.NewTorProxyFromClients(clients, strategy)
+	if err != nil {
+		return nil, fmt.Errorf("creating tor instance: %w", err)
+	}
+
+	healthCheckPeriod := time.Duration(ctx.Int("socks5-health-check-period")) * time.Second
+	proxy.Pool.WithHealthCheck(healthCheckPeriod)
+
+	if len(overrides) > 0 {
+		proxy.Dialer = &torproxy.OverrideDialer{Overrides: overrides, Fallback: proxy.Pool}
+	}
+
+	return proxy, nil
+}
+
+// settingsFromFlags returns the settings of the proxy that can be reloaded, fetching the registry again
+func settingsFromFlags(ctx *config) (*torproxy.Settings, error) {
+	headerPolicy, err := torproxy.ParseHeaderPolicy(ctx.String("header-policy"))
+	if err != nil {
+		return nil, err
+	}
+
+	corsPolicy, err := corsPolicyFromFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	routeClients, err := parseRouteClients(ctx.StringSlice("route-allowed-client"))
+	if err != nil {
+		return nil, err
+	}
+	routes := make(map[string]*torproxy.RouteOptions, len(routeClients)+len(ctx.routes))
+	for host, subjects := range routeClients {
+		routes[strings.ToLower(host)] = &torproxy.RouteOptions{AllowedClients: subjects}
+	}
+	for _, route := range ctx.routes {
+		if err := routeOptionsFromConfig(route, ctx, routes); err != nil {
+			return nil, fmt.Errorf("route %s: %w", route.host, err)
+		}
+	}
+
+	var hostRouting *torproxy.HostRoutingOptions
+	if baseDomains := ctx.StringSlice("host-routing-domain"); len(baseDomains) > 0 {
+		aliases, err := parseAliases(ctx.StringSlice("host-routing-alias"))
+		if err != nil {
+			return nil, err
+		}
+		hostRouting = &torproxy.HostRoutingOptions{
+			BaseDomains: baseDomains,
+			Aliases:     aliases,
+		}
+	}
+
+	if ctx.String("registry") == "" {
+		return nil, errors.New("a registry is required, with --registry or in the config file")
+	}
+
+	// create registry
+	registry, err := registrypkg.NewRegistry(ctx.String("registry"))
+	if err != nil {
+		return nil, fmt.Errorf("loading json: %w", err)
+	}
+
+	return &torproxy.Settings{
+		Registry:       registry,
+		HeaderPolicy:   headerPolicy,
+		CORSPolicy:     corsPolicy,
+		HostRouting:    hostRouting,
+		AllowedClients: ctx.StringSlice("allowed-client"),
+		Routes:         routes,
+	}, nil
+}
+
+// routeOptionsFromConfig adds the options of the route given in the configuration file to routes
+// the header and CORS policies of the route are based on the proxy-wide ones, overridden by the options of the route
+func routeOptionsFromConfig(route *routeConfig, ctx flagValues, routes map[string]*torproxy.RouteOptions) error {
+	host := strings.ToLower(route.host)
+	options, ok := routes[host]
+	if !ok {
+		options = &torproxy.RouteOptions{}
+		routes[host] = options
+	}
+	values := route.flagValues(ctx)
 
+	if route.has("header-policy") {
+		headerPolicy, err := torproxy.ParseHeaderPolicy(values.String("header-policy"))
+		if err != nil {
+			return err
+		}
+		options.Headers = headerPolicy
+	}
+
+	if route.has("cors-allowed-origin", "cors-allowed-origin-regex", "cors-allowed-method", "cors-allowed-header", "cors-exposed-header", "cors-allow-credentials", "cors-max-age") {
+		corsPolicy, err := corsPolicyFromFlags(values)
+		if err != nil {
+			return err
+		}
+		options.CORS = corsPolicy
+	}
+
+	if route.has("allowed-client") {
+		options.AllowedClients = append(options.AllowedClients, values.StringSlice("allowed-client")...)
+	}
 	return nil
 }
 
+// reload reads the configuration file and applies the settings and the TLS certificates again, the current ones are kept if invalid
+// reload applies the routing settings of the configuration file, the options requiring a restart are validated too
+// and logged if they differ from the running ones, given as current
+func reload(cliCtx *cli.Context, proxy *torproxy.TorProxy, current *config) {
+	var settings *torproxy.Settings
+	ctx, err := loadConfig(cliCtx)
+	if err == nil {
+		err = validateRestartOptions(ctx)
+	}
+	if err == nil {
+		settings, err = settingsFromFlags(ctx)
+	}
+	if err == nil {
+		for _, name := range current.changedRestartOptions(ctx) {
+			log.Printf("option %s changed, restart to apply it\n", name)
+		}
+		var changes []string
+		if changes, err = proxy.Reload(settings); err == nil {
+			log.Printf("Reloaded configuration, %d change(s)\n", len(changes))
+			for _, change := range changes {
+				log.Printf("  %s\n", change)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("reloading configuration: %v, keeping the current one\n", err)
+	}
+
+	if err := proxy.ReloadCertificates(); err != nil {
+		log.Printf("%v, keeping the current pair of these listeners\n", err)
+		return
+	}
+	if expiry := proxy.CertificateExpiry(); !expiry.IsZero() {
+		log.Printf("Reloaded TLS certificates, expiring at %s\n", expiry.Format(time.RFC3339))
+	}
+}
+
+// validateRestartOptions checks the options applied at start only, without applying them
+// the TLS policy is checked even if the listeners don't use TLS, so that a broken one never waits for the next restart
+func validateRestartOptions(ctx flagValues) error {
+	if _, err := listenersFromFlags(ctx); err != nil {
+		return err
+	}
+	if _, err := tlsPolicyFromFlags(ctx); err != nil {
+		return err
+	}
+	if _, err := torproxy.ParseOverrides(ctx.StringSlice("override")); err != nil {
+		return err
+	}
+	if _, err := torClientsFromFlags(ctx); err != nil {
+		return err
+	}
+	_, err := torproxy.ParseBalancingStrategy(ctx.String("socks5-balancing"))
+	return err
+}
+
+func corsPolicyFromFlags(ctx flagValues) (*torproxy.CORSPolicy, error) {
+	originRegexps, err := torproxy.CompileOriginRegexps(ctx.StringSlice("cors-allowed-origin-regex"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &torproxy.CORSPolicy{
+		AllowedOrigins:       ctx.StringSlice("cors-allowed-origin"),
+		AllowedOriginRegexps: originRegexps,
+		AllowedMethods:       ctx.StringSlice("cors-allowed-method"),
+		AllowedHeaders:       ctx.StringSlice("cors-allowed-header"),
+		ExposedHeaders:       ctx.StringSlice("cors-exposed-header"),
+		AllowCredentials:     ctx.Bool("cors-allow-credentials"),
+		MaxAge:               time.Duration(ctx.Int("cors-max-age")) * time.Second,
+	}, nil
+}
+
+// tlsPolicyFromFlags returns the TLS preset with the overrides given by flags
+func tlsPolicyFromFlags(ctx flagValues) (*torproxy.TLSPolicy, error) {
+	policy, err := torproxy.ParseTLSPolicy(ctx.String("tls-policy"))
+	if err != nil {
+		return nil, err
+	}
+
+	if v := ctx.String("tls-min-version"); v != "" {
+		if policy.MinVersion, err = torproxy.ParseTLSVersion(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := ctx.String("tls-max-version"); v != "" {
+		if policy.MaxVersion, err = torproxy.ParseTLSVersion(v); err != nil {
+			return nil, err
+		}
+	}
+	if names := ctx.StringSlice("tls-cipher"); len(names) > 0 {
+		if policy.CipherSuites, err = torproxy.ParseCipherSuites(names); err != nil {
+			return nil, err
+		}
+	}
+	if names := ctx.StringSlice("tls-curve"); len(names) > 0 {
+		if policy.CurvePreferences, err = torproxy.ParseCurves(names); err != nil {
+			return nil, err
+		}
+	}
+	if protos := ctx.StringSlice("tls-alpn"); len(protos) > 0 {
+		policy.NextProtos = protos
+	}
+
+	if policy.MaxVersion != 0 && policy.MaxVersion < policy.MinVersion {
+		return nil, errors.New("TLS max version must not be lower than min version")
+	}
+
+	return policy, nil
+}
+
+// parseRouteClients groups a list of <onion_host>=<subject> by onion host
+func parseRouteClients(values []string) (map[string][]string, error) {
+	clients := make(map[string][]string)
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid route allowed client %q, must be <onion_host>=<subject>", v)
+		}
+		clients[parts[0]] = append(clients[parts[0]], parts[1])
+	}
+	return clients, nil
+}
+
+func parseAliases(values []string) (map[string]string, error) {
+	aliases := make(map[string]string, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], ".") {
+			return nil, fmt.Errorf("invalid alias %q, must be <alias>=<onion_host>", v)
+		}
+		aliases[parts[0]] = parts[1]
+	}
+	return aliases, nil
+}
+
+func torClientsFromFlags(ctx flagValues) ([]*torproxy.TorClient, error) {
+	username := ctx.String("socks5-username")
+	password := ctx.String("socks5-password")
+
+	backends := ctx.StringSlice("socks5-backend")
+	if len(backends) == 0 {
+		return []*torproxy.TorClient{{
+			Host:     ctx.String("socks5-hostname"),
+			Port:     ctx.Int("socks5-port"),
+			Username: username,
+			Password: password,
+		}}, nil
+	}
+
+	clients := make([]*torproxy.TorClient, 0, len(backends))
+	for _, b := range backends {
+		host, port, err := net.SplitHostPort(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5 backend %s: %w", b, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5 backend port %s: %w", b, err)
+		}
+		clients = append(clients, &torproxy.TorClient{
+			Host:     host,
+			Port:     p,
+			Username: username,
+			Password: password,
+		})
+	}
+
+	return clients, nil
+}
+
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".torproxy"
+	}
+	return filepath.Join(home, ".torproxy")
+}
+
 func isValidDomain(d string) bool {
-	_, err := publicsuffix.Parse(d)
+	_, err := publicsuffix.Parse(strings.TrimPrefix(d, "*."))
 	return err == nil
 }
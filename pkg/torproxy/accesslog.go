@@ -0,0 +1,60 @@
+package torproxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// accessLog logs a line for every request served by the handler, with the identity of the verified client, if any
+// the gRPC calls are logged with their method, final status and the number of messages received and sent
+func accessLog(logger *log.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// the onion prefix is removed from the path while routing
+		path := r.URL.Path
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		// deferred to log the requests aborted by the reverse proxy too
+		defer func() {
+			client := ClientIdentity(r)
+			if client == "" {
+				client = "-"
+			}
+			line := fmt.Sprintf("%s %s %s %s %d %d %s client=%q", r.RemoteAddr, r.Method, r.Host, path, rec.status, rec.written, time.Since(start), client)
+			if call := grpcCallFrom(r); call != nil {
+				received, sent := call.Messages()
+				line += fmt.Sprintf(" grpc=%s/%s grpc-status=%s messages=%d/%d", call.Service, call.Method, call.Status(), received, sent)
+			}
+			logger.Print(line)
+		}()
+
+		handler.ServeHTTP(rec, r)
+	})
+}
+
+// statusRecorder records the status and the size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.written += int64(n)
+	return n, err
+}
+
+// Flush is required to stream the responses, eg. gRPC server streams
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,172 @@
+package torproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCertificateWatchPeriod is how often the certificate files are checked for changes
+const DefaultCertificateWatchPeriod = 10 * time.Second
+
+// CertificateLoader serves a key pair loaded from the filesystem, reloading it when the files change
+// a new pair is swapped in only if valid, otherwise the current one is kept
+type CertificateLoader struct {
+	CertFile string
+	KeyFile  string
+
+	certificate atomic.Value // *tls.Certificate
+	reloads     uint64
+	failures    uint64
+
+	mu       sync.Mutex
+	modTimes [2]time.Time
+	quit     chan struct{}
+	once     sync.Once
+}
+
+// NewCertificateLoader loads and validates the key pair at the given paths
+func NewCertificateLoader(certFile, keyFile string) (*CertificateLoader, error) {
+	l := &CertificateLoader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		quit:     make(chan struct{}),
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload loads the key pair from the files and swaps it with the current one if valid
+func (l *CertificateLoader) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	modTimes, err := l.stat()
+	if err != nil {
+		atomic.AddUint64(&l.failures, 1)
+		return err
+	}
+
+	// an invalid pair is not retried by Watch until the files change again
+	l.modTimes = modTimes
+
+	certificate, err := loadKeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		atomic.AddUint64(&l.failures, 1)
+		return err
+	}
+
+	l.certificate.Store(certificate)
+	atomic.AddUint64(&l.reloads, 1)
+	return nil
+}
+
+// GetCertificate returns the current certificate, to be used as tls.Config.GetCertificate
+func (l *CertificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.certificate.Load().(*tls.Certificate), nil
+}
+
+// NotAfter returns the expiration time of the current certificate
+func (l *CertificateLoader) NotAfter() time.Time {
+	return l.certificate.Load().(*tls.Certificate).Leaf.NotAfter
+}
+
+// Reloads returns the number of successful loads of the key pair, the first one included
+func (l *CertificateLoader) Reloads() uint64 {
+	return atomic.LoadUint64(&l.reloads)
+}
+
+// Failures returns the number of failed reloads
+func (l *CertificateLoader) Failures() uint64 {
+	return atomic.LoadUint64(&l.failures)
+}
+
+// Watch checks the files every period and reloads the key pair when they change, until Close is called
+func (l *CertificateLoader) Watch(period time.Duration) {
+	if period <= 0 {
+		period = DefaultCertificateWatchPeriod
+	}
+
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.quit:
+				return
+			case <-ticker.C:
+				if !l.changed() {
+					continue
+				}
+				if err := l.Reload(); err != nil {
+					log.Printf("reloading certificate %s: %v, keeping the current one", l.CertFile, err)
+					continue
+				}
+				log.Printf("reloaded certificate %s, expires at %s", l.CertFile, l.NotAfter().Format(time.RFC3339))
+			}
+		}
+	}()
+}
+
+// Close stops watching the files
+func (l *CertificateLoader) Close() {
+	l.once.Do(func() {
+		close(l.quit)
+	})
+}
+
+// changed returns true if the modification time of any of the files differs from the loaded ones
+func (l *CertificateLoader) changed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	modTimes, err := l.stat()
+	if err != nil {
+		// the files may be in the middle of a rotation, check again at the next tick
+		return false
+	}
+	return modTimes != l.modTimes
+}
+
+func (l *CertificateLoader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{l.CertFile, l.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// loadKeyPair loads the key pair, checking that the key matches the certificate and the certificate is not expired
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading key pair: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate %s expired at %s", certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate %s not valid before %s", certFile, leaf.NotBefore.Format(time.RFC3339))
+	}
+	certificate.Leaf = leaf
+
+	return &certificate, nil
+}
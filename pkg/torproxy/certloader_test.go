@@ -0,0 +1,218 @@
+package torproxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// certificateDir returns a temporary directory for the key pairs of the test
+func certificateDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "torproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// served returns the serial number of the certificate served by the loader
+func served(t *testing.T, loader *torproxy.CertificateLoader) string {
+	t.Helper()
+
+	cert, err := loader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.String()
+}
+
+func serial(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.String()
+}
+
+func TestCertificateLoaderReload(t *testing.T) {
+	ca, dir := newTestCA(t), certificateDir(t)
+	expiry := time.Now().Add(24 * time.Hour)
+	first := ca.issue(t, "localhost", expiry, "localhost")
+	certPath, keyPath := writeCertificate(t, dir, first)
+
+	loader, err := torproxy.NewCertificateLoader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loader.Close()
+	if got, want := served(t, loader), serial(t, first); got != want {
+		t.Fatalf("got certificate %s, want %s", got, want)
+	}
+
+	rotated := ca.issue(t, "localhost", expiry.Add(time.Hour), "localhost")
+	writeCertificate(t, dir, rotated)
+	if err := loader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := served(t, loader), serial(t, rotated); got != want {
+		t.Fatalf("got certificate %s after the reload, want the rotated one %s", got, want)
+	}
+	if !loader.NotAfter().Equal(expiry.Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("got expiry %s, want the one of the rotated certificate %s", loader.NotAfter(), expiry.Add(time.Hour))
+	}
+
+	other := ca.issue(t, "localhost", expiry, "localhost")
+	invalid := []struct {
+		name string
+		pair tls.Certificate
+	}{
+		{"key not matching the certificate", tls.Certificate{Certificate: other.Certificate, PrivateKey: rotated.PrivateKey}},
+		{"expired certificate", ca.issue(t, "localhost", time.Now().Add(-time.Minute), "localhost")},
+	}
+	for i, tt := range invalid {
+		writeCertificate(t, dir, tt.pair)
+		if err := loader.Reload(); err == nil {
+			t.Errorf("%s: got the pair reloaded, want an error", tt.name)
+		}
+		if got, want := served(t, loader), serial(t, rotated); got != want {
+			t.Errorf("%s: got certificate %s, want the current one %s kept", tt.name, got, want)
+		}
+		if n := loader.Failures(); n != uint64(i+1) {
+			t.Errorf("%s: got %d failures, want %d", tt.name, n, i+1)
+		}
+	}
+	if n := loader.Reloads(); n != 2 {
+		t.Errorf("got %d reloads, want the first load and the rotation", n)
+	}
+}
+
+func TestCertificateLoaderWatch(t *testing.T) {
+	ca, dir := newTestCA(t), certificateDir(t)
+	expiry := time.Now().Add(24 * time.Hour)
+	certPath, keyPath := writeCertificate(t, dir, ca.issue(t, "localhost", expiry, "localhost"))
+
+	loader, err := torproxy.NewCertificateLoader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loader.Close()
+	loader.Watch(10 * time.Millisecond)
+
+	rotated := ca.issue(t, "localhost", expiry, "localhost")
+	writeCertificate(t, dir, rotated)
+	// the modification time may not change within the resolution of the filesystem
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for served(t, loader) != serial(t, rotated) {
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated certificate has not been picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadCertificates(t *testing.T) {
+	ca, dir := newTestCA(t), certificateDir(t)
+	expiry := time.Now().Add(24 * time.Hour)
+	first := ca.issue(t, "localhost", expiry, "localhost")
+	certPath, keyPath := writeCertificate(t, dir, first)
+
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+
+	address := freeAddress(t)
+	go tp.ServeListeners([]*torproxy.ListenerOptions{{
+		Address: address,
+		// the files are reloaded on ReloadCertificates only
+		TLS: &torproxy.TLSOptions{TLSCert: certPath, TLSKey: keyPath, CertWatchPeriod: time.Hour},
+	}})
+	waitListening(t, address)
+
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}}}
+	}
+	get := func(client *http.Client) string {
+		t.Helper()
+
+		res, err := client.Get("https://" + address + route + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+
+	connected := newClient()
+	if got, want := get(connected), serial(t, first); got != want {
+		t.Fatalf("got certificate %s, want %s", got, want)
+	}
+
+	rotated := ca.issue(t, "localhost", expiry.Add(time.Hour), "localhost")
+	writeCertificate(t, dir, rotated)
+	if err := tp.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connections are not dropped, the new ones get the rotated certificate
+	if got, want := get(connected), serial(t, first); got != want {
+		t.Errorf("got certificate %s on the open connection, want it kept with %s", got, want)
+	}
+	if got, want := get(newClient()), serial(t, rotated); got != want {
+		t.Errorf("got certificate %s on a new connection, want the rotated one %s", got, want)
+	}
+	if !tp.CertificateExpiry().Equal(expiry.Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("got expiry %s, want the one of the rotated certificate", tp.CertificateExpiry())
+	}
+
+	// an invalid pair is refused, the rotated one is still served
+	writeCertificate(t, dir, ca.issue(t, "localhost", time.Now().Add(-time.Minute), "localhost"))
+	if err := tp.ReloadCertificates(); err == nil {
+		t.Fatal("got an expired certificate reloaded, want an error")
+	}
+	if got, want := get(newClient()), serial(t, rotated); got != want {
+		t.Errorf("got certificate %s after a refused reload, want %s", got, want)
+	}
+}
+
+// waitListening waits for the address to accept connections
+func waitListening(t *testing.T, address string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not listening: %v", address, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
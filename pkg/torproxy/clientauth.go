@@ -0,0 +1,129 @@
+package torproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ClientAuthMode is an enum-like type that represents how the TLS listener verifies the client certificates
+type ClientAuthMode int
+
+const (
+	NoClientAuth ClientAuthMode = iota
+	// OptionalClientAuth verifies the client certificate if given, clients without certificate are accepted
+	OptionalClientAuth
+	// RequiredClientAuth refuses the TLS handshake of clients without a valid certificate
+	RequiredClientAuth
+)
+
+// ParseClientAuthMode returns the ClientAuthMode matching the given name
+func ParseClientAuthMode(name string) (ClientAuthMode, error) {
+	switch name {
+	case "", "none":
+		return NoClientAuth, nil
+	case "optional":
+		return OptionalClientAuth, nil
+	case "required":
+		return RequiredClientAuth, nil
+	default:
+		return NoClientAuth, fmt.Errorf("unknown client auth mode %q", name)
+	}
+}
+
+// ClientAuthOptions enables mutual TLS on a listener
+type ClientAuthOptions struct {
+	Mode ClientAuthMode
+	// CAFile is the path of the PEM bundle of the CAs issuing the client certificates, ignored if ClientCAs is set
+	CAFile    string
+	ClientCAs *x509.CertPool
+}
+
+// apply sets the client verification on the given config
+func (o *ClientAuthOptions) apply(config *tls.Config) error {
+	if o.Mode == NoClientAuth {
+		return nil
+	}
+
+	pool := o.ClientCAs
+	if pool == nil {
+		if o.CAFile == "" {
+			return errors.New("a CA bundle is required to verify the client certificates")
+		}
+		bundle, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return fmt.Errorf("reading client CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("no certificate found in client CA bundle %s", o.CAFile)
+		}
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if o.Mode == RequiredClientAuth {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// clientCertificate returns the verified client certificate of the request, nil if none
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// ClientIdentity returns the subject common name of the verified client certificate, or its first DNS name
+// an empty string is returned if the client has not been verified
+func ClientIdentity(r *http.Request) string {
+	cert := clientCertificate(r)
+	if cert == nil {
+		return ""
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.String()
+}
+
+// isClientAllowed returns true if the verified client certificate of the request matches one of the subjects
+// the common name, DNS and email names of the certificate are compared, "*" matches any verified client
+// any client is allowed if no subjects are given
+func isClientAllowed(r *http.Request, subjects []string) bool {
+	if len(subjects) == 0 {
+		return true
+	}
+
+	cert := clientCertificate(r)
+	if cert == nil {
+		return false
+	}
+
+	names := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses))
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, s := range subjects {
+		if s == "*" {
+			return true
+		}
+		for _, name := range names {
+			if matchDomain(s, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
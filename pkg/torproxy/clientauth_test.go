@@ -0,0 +1,266 @@
+package torproxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// testCA issues the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "torproxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate valid until notAfter for the given common name and DNS names, usable by clients and servers
+func (ca *testCA) issue(t *testing.T, commonName string, notAfter time.Time, dnsNames ...string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// mtlsProxy serves both test onions behind a proxy verifying the client certificates issued by the CA, if given
+// it returns the server and the number of requests received by the onions
+func mtlsProxy(t *testing.T, ca *testCA, configure func(tp *torproxy.TorProxy)) (*httptest.Server, *int64, func()) {
+	t.Helper()
+
+	var requests int64
+	socks := torproxytest.NewServer()
+	for _, host := range []string{onionHost, secondOnionHost} {
+		socks.AddOnion(host, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&requests, 1)
+		}))
+	}
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint, "http://"+secondOnionHost+":80")
+	if err != nil {
+		socks.Close()
+		t.Fatal(err)
+	}
+	configure(tp)
+
+	srv := httptest.NewUnstartedServer(tp.Handler())
+	srv.TLS = &tls.Config{ClientCAs: ca.pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+
+	return srv, &requests, func() {
+		srv.Close()
+		tp.Pool.Close()
+		socks.Close()
+	}
+}
+
+// clientWithCertificate returns a client of the server presenting the given certificates
+func clientWithCertificate(srv *httptest.Server, certs ...tls.Certificate) *http.Client {
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certs
+	client.Transport = transport
+	return client
+}
+
+func TestAllowedClients(t *testing.T) {
+	ca := newTestCA(t)
+	srv, _, closeFunc := mtlsProxy(t, ca, func(tp *torproxy.TorProxy) {
+		tp.AllowedClients = []string{"*.internal.example.com"}
+		tp.WithRouteOptions(secondOnionHost, &torproxy.RouteOptions{AllowedClients: []string{"billing"}})
+	})
+	defer closeFunc()
+
+	expiry := time.Now().Add(time.Hour)
+	api := ca.issue(t, "api.internal.example.com", expiry)
+	apiByDNSName := ca.issue(t, "", expiry, "api.internal.example.com")
+	billing := ca.issue(t, "billing", expiry)
+
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		path   string
+		status int
+	}{
+		{"no certificate", nil, route + "/", http.StatusForbidden},
+		{"common name matching the proxy-wide subjects", []tls.Certificate{api}, route + "/", http.StatusOK},
+		{"DNS name matching the proxy-wide subjects", []tls.Certificate{apiByDNSName}, route + "/", http.StatusOK},
+		{"subject of another route", []tls.Certificate{billing}, route + "/", http.StatusForbidden},
+		{"subject of the route", []tls.Certificate{billing}, secondRoute + "/", http.StatusOK},
+		{"proxy-wide subject overridden by the route", []tls.Certificate{api}, secondRoute + "/", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		res, err := clientWithCertificate(srv, tt.certs...).Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, res.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestAllowedClientsPreflight(t *testing.T) {
+	ca := newTestCA(t)
+	srv, requests, closeFunc := mtlsProxy(t, ca, func(tp *torproxy.TorProxy) {
+		tp.AllowedClients = []string{"*.internal.example.com"}
+	})
+	defer closeFunc()
+
+	// browsers send the preflights without client certificate
+	req, err := http.NewRequest(http.MethodOptions, srv.URL+route+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d for the preflight of a restricted route, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	if v := res.Header.Get("Access-Control-Allow-Origin"); v != "*" {
+		t.Errorf("got Access-Control-Allow-Origin: %q, want %q", v, "*")
+	}
+
+	// the actual requests without certificate are still refused, OPTIONS included
+	for _, method := range []string{http.MethodOptions, http.MethodPost} {
+		req, err := http.NewRequest(method, srv.URL+route+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", "https://app.example.com")
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got status %d without certificate, want %d", method, res.StatusCode, http.StatusForbidden)
+		}
+	}
+	if n := atomic.LoadInt64(requests); n != 0 {
+		t.Fatalf("got %d requests proxied to the onion, want 0", n)
+	}
+}
+
+func TestClientAuthACMEChallenge(t *testing.T) {
+	storage, err := ioutil.TempDir("", "certmagic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storage)
+
+	ca := newTestCA(t)
+	tp := torproxy.NewTorProxyWithDialer(nil)
+	defer tp.Close()
+	config, err := tp.TLSConfig(&torproxy.TLSOptions{
+		Storage:    &certmagic.FileStorage{Path: storage},
+		OnDemand:   true,
+		ClientAuth: &torproxy.ClientAuthOptions{Mode: torproxy.RequiredClientAuth, ClientCAs: ca.pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("got client auth %v, want the client certificate required", config.ClientAuth)
+	}
+
+	// the CA solving TLS-ALPN challenges has no client certificate
+	acmeConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acmez.ACMETLS1Protocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acmeConfig == nil || acmeConfig.ClientAuth != tls.NoClientCert {
+		t.Fatalf("got %+v for a TLS-ALPN challenge, want a config without client authentication", acmeConfig)
+	}
+	if !containsProto(acmeConfig.NextProtos, acmez.ACMETLS1Protocol) {
+		t.Errorf("got ALPN protocols %q for a TLS-ALPN challenge, want %q", acmeConfig.NextProtos, acmez.ACMETLS1Protocol)
+	}
+
+	clientConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientConfig != nil {
+		t.Fatalf("got a config of its own for a client, want the one requiring a certificate")
+	}
+}
+
+func containsProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package torproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy defines the Cross-Origin Resource Sharing headers set on both preflight and actual responses
+type CORSPolicy struct {
+	// AllowedOrigins lists the allowed origins, "*" allows any origin
+	// a single wildcard is supported in place of a subdomain, eg. https://*.example.com
+	AllowedOrigins []string
+	// AllowedOriginRegexps lists regular expressions matched against the whole origin, see CompileOriginRegexps
+	AllowedOriginRegexps []*regexp.Regexp
+	AllowedMethods       []string
+	// AllowedHeaders lists the request headers allowed in preflight, "*" allows any header
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers readable by the browser
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long the browser can cache the preflight response, not sent if zero
+	MaxAge time.Duration
+}
+
+// DefaultCORSPolicy returns the permissive policy allowing any origin
+func DefaultCORSPolicy() *CORSPolicy {
+	return &CORSPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{
+			http.MethodPost, http.MethodGet, http.MethodOptions, http.MethodPut, http.MethodDelete,
+		},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"grpc-status", "grpc-message"},
+	}
+}
+
+// CompileOriginRegexps compiles the given expressions to be used as AllowedOriginRegexps
+// the expressions are anchored to match the whole origin, eg. https://example\.com does not allow https://example.com.evil.net
+func CompileOriginRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(exprs))
+	for _, e := range exprs {
+		re, err := regexp.Compile("^(?:" + e + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin regexp %q: %w", e, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// isOriginAllowed returns true if the origin matches the allowed origins or regexps
+func (p *CORSPolicy) isOriginAllowed(origin string) bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" || matchOrigin(o, origin) {
+			return true
+		}
+	}
+	for _, re := range p.AllowedOriginRegexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowsAnyOrigin() bool {
+	for _, o := range p.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// isPreflight returns true if r is a CORS preflight request
+// browsers send them without credentials, in particular without client certificate
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handle sets the CORS headers on w for the request r
+// it returns true if r is a preflight request, already answered
+func (p *CORSPolicy) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions
+
+	if origin == "" || !p.isOriginAllowed(origin) {
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if preflight {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	header := w.Header()
+	if p.allowsAnyOrigin() && !p.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+	}
+	if p.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(p.ExposedHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	if len(p.AllowedMethods) > 0 {
+		header.Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+	}
+	if len(p.AllowedHeaders) > 0 {
+		allowedHeaders := strings.Join(p.AllowedHeaders, ", ")
+		// the wildcard is not honored by browsers for credentialed requests, reflect the requested headers instead
+		if allowedHeaders == "*" && p.AllowCredentials {
+			allowedHeaders = r.Header.Get("Access-Control-Request-Headers")
+		}
+		if allowedHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", allowedHeaders)
+		}
+	}
+	if p.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+// matchOrigin compares the origin with the allowed one, supporting a single * wildcard
+func matchOrigin(allowed, origin string) bool {
+	allowed = strings.ToLower(allowed)
+	origin = strings.ToLower(origin)
+
+	i := strings.Index(allowed, "*")
+	if i < 0 {
+		return allowed == origin
+	}
+	prefix, suffix := allowed[:i], allowed[i+1:]
+	return len(origin) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) &&
+		strings.HasSuffix(origin, suffix)
+}
+
+// removeCorsHeaders drops the CORS headers sent by the upstream, the proxy policy applies instead
+func removeCorsHeaders(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, "Access-Control-") {
+			h.Del(k)
+		}
+	}
+}
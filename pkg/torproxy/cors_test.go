@@ -0,0 +1,162 @@
+package torproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// corsProxy serves the test onion, setting its own permissive CORS headers, with the given policy
+// it returns the URL of the proxy and the number of requests received by the onion
+func corsProxy(t *testing.T, policy *torproxy.CORSPolicy) (string, *int64, func()) {
+	t.Helper()
+
+	var requests int64
+	socks := torproxytest.NewServer()
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example.com")
+	}))
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		socks.Close()
+		t.Fatal(err)
+	}
+	tp.CORSPolicy = policy
+	srv := httptest.NewServer(tp.Handler())
+
+	return srv.URL + route + "/", &requests, func() {
+		srv.Close()
+		tp.Pool.Close()
+		socks.Close()
+	}
+}
+
+func corsRequest(t *testing.T, method, url, origin string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", origin)
+	if method == http.MethodOptions {
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-grpc-web")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestDefaultCORSPolicy(t *testing.T) {
+	url, requests, closeFunc := corsProxy(t, nil)
+	defer closeFunc()
+
+	res := corsRequest(t, http.MethodOptions, url, "https://app.example.com")
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d for the preflight, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	if v := res.Header.Get("Access-Control-Allow-Origin"); v != "*" {
+		t.Errorf("got Access-Control-Allow-Origin: %q, want %q", v, "*")
+	}
+	if v := res.Header.Get("Access-Control-Allow-Headers"); v != "*" {
+		t.Errorf("got Access-Control-Allow-Headers: %q, want %q", v, "*")
+	}
+	if n := atomic.LoadInt64(requests); n != 0 {
+		t.Fatalf("got %d preflight requests proxied to the onion, want 0", n)
+	}
+
+	res = corsRequest(t, http.MethodGet, url, "https://app.example.com")
+	if v := res.Header.Get("Access-Control-Allow-Origin"); v != "*" {
+		t.Errorf("got Access-Control-Allow-Origin: %q, want the proxy policy instead of the onion one", v)
+	}
+	if v := res.Header.Get("Access-Control-Expose-Headers"); v != "grpc-status, grpc-message" {
+		t.Errorf("got Access-Control-Expose-Headers: %q, want the gRPC-Web ones", v)
+	}
+}
+
+func TestCORSPolicyOrigins(t *testing.T) {
+	regexps, err := torproxy.CompileOriginRegexps([]string{`https://app[0-9]\.example\.com`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &torproxy.CORSPolicy{
+		AllowedOrigins:       []string{"https://example.com", "https://*.example.org"},
+		AllowedOriginRegexps: regexps,
+		AllowedMethods:       []string{http.MethodPost},
+		AllowedHeaders:       []string{"*"},
+		AllowCredentials:     true,
+		MaxAge:               10 * time.Minute,
+	}
+	url, requests, closeFunc := corsProxy(t, policy)
+	defer closeFunc()
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"https://api.example.org", true},
+		{"https://app1.example.com", true},
+		{"https://example.org", false},
+		{"http://example.com", false},
+		{"https://example.com.evil.net", false},
+		{"https://app1.example.com.evil.net", false},
+		{"https://evil.net/https://app1.example.com", false},
+	}
+
+	for _, tt := range tests {
+		res := corsRequest(t, http.MethodOptions, url, tt.origin)
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("%s: got status %d for the preflight, want %d", tt.origin, res.StatusCode, http.StatusNoContent)
+		}
+
+		allowOrigin := res.Header.Get("Access-Control-Allow-Origin")
+		if !tt.allowed {
+			if allowOrigin != "" {
+				t.Errorf("%s: got Access-Control-Allow-Origin: %s, want the origin refused", tt.origin, allowOrigin)
+			}
+			continue
+		}
+
+		// the origin is reflected, the wildcard is not honored with credentials
+		if allowOrigin != tt.origin {
+			t.Errorf("%s: got Access-Control-Allow-Origin: %q, want the origin", tt.origin, allowOrigin)
+		}
+		if v := res.Header.Get("Access-Control-Allow-Credentials"); v != "true" {
+			t.Errorf("%s: got Access-Control-Allow-Credentials: %q, want %q", tt.origin, v, "true")
+		}
+		if v := res.Header.Get("Access-Control-Allow-Headers"); v != "content-type, x-grpc-web" {
+			t.Errorf("%s: got Access-Control-Allow-Headers: %q, want the requested headers", tt.origin, v)
+		}
+		if v := res.Header.Get("Access-Control-Max-Age"); v != "600" {
+			t.Errorf("%s: got Access-Control-Max-Age: %q, want %q", tt.origin, v, "600")
+		}
+		if v := res.Header.Get("Vary"); v != "Origin" {
+			t.Errorf("%s: got Vary: %q, want %q", tt.origin, v, "Origin")
+		}
+	}
+	if n := atomic.LoadInt64(requests); n != 0 {
+		t.Fatalf("got %d preflight requests proxied to the onion, want 0", n)
+	}
+
+	// the actual requests of a refused origin are proxied, without the CORS headers of the onion
+	res := corsRequest(t, http.MethodGet, url, "https://example.com.evil.net")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if v := res.Header.Get("Access-Control-Allow-Origin"); v != "" {
+		t.Fatalf("got Access-Control-Allow-Origin: %s, want none for a refused origin", v)
+	}
+}
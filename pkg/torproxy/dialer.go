@@ -0,0 +1,75 @@
+package torproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// OverrideDialer dials the local address mapped to the destination onion host, bypassing the SOCKS5 proxy
+// useful to run the full routing stack against local daemons, without tor nor network
+// destinations without override are dialed with Fallback, or refused if Fallback is nil
+type OverrideDialer struct {
+	// Overrides maps an onion host, with or without port, to a local host:port
+	Overrides map[string]string
+	Fallback  proxy.ContextDialer
+}
+
+// ParseOverrides parses a list of <onion_host>[:<port>]=<host>:<port> into a map of overrides
+func ParseOverrides(values []string) (map[string]string, error) {
+	overrides := make(map[string]string, len(values))
+	for _, v := range values {
+		from, to := splitOverride(v)
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid override %q, must be <onion_host>=<host>:<port>", v)
+		}
+		if _, _, err := net.SplitHostPort(to); err != nil {
+			return nil, fmt.Errorf("invalid override %q: %w", v, err)
+		}
+		overrides[strings.ToLower(from)] = to
+	}
+	return overrides, nil
+}
+
+func splitOverride(v string) (string, string) {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])
+}
+
+// Dial connects to the address mapped to the given one
+func (d *OverrideDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address mapped to the given one
+func (d *OverrideDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if to, ok := d.lookup(address); ok {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, to)
+	}
+
+	if d.Fallback == nil {
+		return nil, fmt.Errorf("no override for %s", address)
+	}
+	return d.Fallback.DialContext(ctx, network, address)
+}
+
+func (d *OverrideDialer) lookup(address string) (string, bool) {
+	address = strings.ToLower(address)
+	if to, ok := d.Overrides[address]; ok {
+		return to, true
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", false
+	}
+	to, ok := d.Overrides[host]
+	return to, ok
+}
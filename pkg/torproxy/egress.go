@@ -0,0 +1,138 @@
+package torproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/proxy"
+)
+
+// ErrEgressRefused is returned when dialing a destination not allowed by the egress policy
+type ErrEgressRefused struct {
+	Address string
+}
+
+func (e *ErrEgressRefused) Error() string {
+	return fmt.Sprintf("egress to %s refused: not an onion address", e.Address)
+}
+
+// EgressPolicy restricts the upstream destinations to .onion addresses
+// clearnet hosts are refused unless explicitly allowed, see AllowClearnet
+// the destination is always passed as is to the upstream dialer, the policy never resolves it locally
+type EgressPolicy struct {
+	mu       sync.RWMutex
+	clearnet map[string]bool
+	refused  uint64
+}
+
+// NewEgressPolicy returns an *EgressPolicy allowing .onion destinations only
+func NewEgressPolicy() *EgressPolicy {
+	return &EgressPolicy{clearnet: make(map[string]bool)}
+}
+
+// AllowClearnet opts-in the given clearnet host as upstream destination
+func (p *EgressPolicy) AllowClearnet(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clearnet[strings.ToLower(host)] = true
+}
+
+// revokeClearnet refuses again the given clearnet host
+func (p *EgressPolicy) revokeClearnet(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.clearnet, strings.ToLower(host))
+}
+
+// Check returns an *ErrEgressRefused if the destination address is not allowed
+func (p *EgressPolicy) Check(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if isOnionHost(host) {
+		return nil
+	}
+
+	p.mu.RLock()
+	allowed := p.clearnet[host]
+	p.mu.RUnlock()
+	if allowed {
+		return nil
+	}
+
+	atomic.AddUint64(&p.refused, 1)
+	log.Printf("egress refused to %s", address)
+	return &ErrEgressRefused{Address: address}
+}
+
+// Refused returns the number of refused egress attempts
+func (p *EgressPolicy) Refused() uint64 {
+	return atomic.LoadUint64(&p.refused)
+}
+
+// Dialer wraps the given dialer enforcing the policy before every dial
+func (p *EgressPolicy) Dialer(dialer proxy.ContextDialer) proxy.ContextDialer {
+	return &egressDialer{policy: p, dialer: dialer}
+}
+
+type egressDialer struct {
+	policy *EgressPolicy
+	dialer proxy.ContextDialer
+}
+
+func (d *egressDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *egressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := d.policy.Check(address); err != nil {
+		return nil, err
+	}
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+// isOnionHost returns true if the host is a well-formed hostname under the .onion special-use domain
+// the service id, the last label before .onion, must be a 56 characters v3 one or a 16 characters v2 one
+func isOnionHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	label := strings.TrimSuffix(host, ".onion")
+	if label == host || label == "" {
+		return false
+	}
+	// subdomains are allowed
+	if i := strings.LastIndex(label, "."); i >= 0 {
+		label = label[i+1:]
+	}
+	if len(label) != onionV3Length && len(label) != onionV2Length {
+		return false
+	}
+	return isBase32(label)
+}
+
+// lengths of the base32 service ids of the onion services
+const (
+	onionV3Length = 56
+	onionV2Length = 16
+)
+
+func isBase32(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z') && !(c >= '2' && c <= '7') {
+			return false
+		}
+	}
+	return true
+}
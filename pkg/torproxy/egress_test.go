@@ -0,0 +1,162 @@
+package torproxy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tdex-network/tor-proxy/pkg/registry"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+)
+
+const (
+	onionHost = "torproxytestonionserviceaaaatorproxytestonionserviceaaaa.onion"
+	endpoint  = "http://" + onionHost + ":80"
+)
+
+func TestEgressPolicyCheck(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{onionHost + ":80", true},
+		{"torproxytestaaaa.onion:80", true},
+		{"api." + onionHost + ":443", true},
+		{strings.ToUpper(onionHost) + ":80", true},
+		{onionHost + ".:80", true},
+		{"example.com:80", false},
+		{"127.0.0.1:9050", false},
+		{"[::1]:80", false},
+		{"short.onion:80", false},
+		{onionHost[1:] + ":80", false},
+		{"torproxytest1aaa.onion:80", false},
+		{".onion:80", false},
+		{onionHost + ".example.com:80", false},
+	}
+
+	policy := torproxy.NewEgressPolicy()
+	refused := uint64(0)
+	for _, tt := range tests {
+		err := policy.Check(tt.address)
+		if tt.allowed {
+			if err != nil {
+				t.Errorf("%s: got error %v, want allowed", tt.address, err)
+			}
+			continue
+		}
+
+		refused++
+		var refusedErr *torproxy.ErrEgressRefused
+		if !errors.As(err, &refusedErr) {
+			t.Errorf("%s: got error %v, want *ErrEgressRefused", tt.address, err)
+		}
+	}
+	if got := policy.Refused(); got != refused {
+		t.Fatalf("got %d refused egress attempts, want %d", got, refused)
+	}
+}
+
+func TestEgressPolicyAllowClearnet(t *testing.T) {
+	policy := torproxy.NewEgressPolicy()
+	policy.AllowClearnet("Example.com")
+
+	if err := policy.Check("example.com:443"); err != nil {
+		t.Fatalf("got error %v for the opted-in host, want allowed", err)
+	}
+	if err := policy.Check("api.example.com:443"); err == nil {
+		t.Fatal("got the subdomain of an opted-in host allowed, want refused")
+	}
+}
+
+// countingDialer dials directly, counting the dials
+type countingDialer struct {
+	net.Dialer
+	dials int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials++
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func (d *countingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func TestEgressRefusedClearnetRedirect(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	origin, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := &countingDialer{}
+	tp := torproxy.NewTorProxyWithDialer(dialer)
+	// a redirect added without the clearnet opt-in of the registry
+	tp.Redirects = []*url.URL{origin}
+	srv := httptest.NewServer(tp.Handler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/" + origin.Hostname() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusBadGateway)
+	}
+	if dialer.dials != 0 {
+		t.Fatalf("got %d dials to the clearnet upstream, want 0", dialer.dials)
+	}
+	if got := tp.Egress.Refused(); got != 1 {
+		t.Fatalf("got %d refused egress attempts, want 1", got)
+	}
+}
+
+func TestRegistryClearnetOptIn(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	origin, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearnetRoute := "/" + origin.Hostname() + "/"
+
+	for _, clearnet := range []bool{false, true} {
+		reg, err := registry.NewRegistry(fmt.Sprintf(
+			`[{"endpoint": %q}, {"endpoint": %q, "clearnet": %t}]`, endpoint, upstream.URL, clearnet,
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tp := torproxy.NewTorProxyWithDialer(&countingDialer{})
+		if err := tp.WithRegistry(reg); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(tp.Handler())
+
+		res, err := http.Get(srv.URL + clearnetRoute)
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		want := http.StatusNotFound
+		if clearnet {
+			want = http.StatusOK
+		}
+		if res.StatusCode != want {
+			t.Errorf("clearnet %t: got status %d, want %d", clearnet, res.StatusCode, want)
+		}
+	}
+}
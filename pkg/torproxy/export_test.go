@@ -0,0 +1,8 @@
+package torproxy
+
+import "crypto/tls"
+
+// TLSConfig returns the TLS configuration of a listener with the given options, for the tests
+func (tp *TorProxy) TLSConfig(options *TLSOptions) (*tls.Config, error) {
+	return tp.tlsConfig("", options, nil)
+}
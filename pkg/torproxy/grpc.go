@@ -0,0 +1,229 @@
+package torproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// grpcCodes are the names of the gRPC status codes, as in google.golang.org/grpc/codes
+var grpcCodes = []string{
+	"OK", "CANCELED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+	"PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE",
+	"UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// grpcCall observes a gRPC or gRPC-Web call proxied to an onion
+type grpcCall struct {
+	Service string
+	Method  string
+
+	requests  *grpcFrameCounter
+	responses *grpcFrameCounter
+	header    http.Header
+}
+
+// grpcCallKey is the context key of the *grpcCall of the request
+type grpcCallKey struct{}
+
+// grpcCallFrom returns the gRPC call of the request, nil if it is not a gRPC one
+func grpcCallFrom(r *http.Request) *grpcCall {
+	call, _ := r.Context().Value(grpcCallKey{}).(*grpcCall)
+	return call
+}
+
+// parseGRPCMethod returns the service and the method of the path /[<just_onion_host_without_dot_onion>/]<package>.<service>/<method>
+func parseGRPCMethod(path string) (string, string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", "", false
+	}
+	service, method := parts[len(parts)-2], parts[len(parts)-1]
+	if !strings.Contains(service, ".") || method == "" {
+		return "", "", false
+	}
+	return service, method, true
+}
+
+// isGRPCContentType returns true for gRPC and binary gRPC-Web requests, the base64 gRPC-Web ones are not framed as is
+func isGRPCContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc") && !strings.HasPrefix(contentType, "application/grpc-web-text")
+}
+
+// observeGRPC attaches a *grpcCall to the gRPC requests, counting the messages of both directions
+// it must wrap the access log and the routes to let them report the call
+func observeGRPC(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isGRPCContentType(r.Header.Get("Content-Type")) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		service, method, ok := parseGRPCMethod(r.URL.Path)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		call := &grpcCall{
+			Service:   service,
+			Method:    method,
+			requests:  &grpcFrameCounter{},
+			responses: &grpcFrameCounter{},
+			header:    w.Header(),
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &grpcBody{ReadCloser: r.Body, counter: call.requests}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), grpcCallKey{}, call))
+		handler.ServeHTTP(&grpcResponseWriter{ResponseWriter: w, counter: call.responses}, r)
+	})
+}
+
+// Status returns the name of the final gRPC status of the call, from the trailers or the headers of a trailers-only response
+// UNKNOWN is returned if the onion did not answer with a gRPC status, eg. unreachable
+func (c *grpcCall) Status() string {
+	code, err := strconv.Atoi(c.rawStatus())
+	if err != nil || code < 0 {
+		return "UNKNOWN"
+	}
+	if code >= len(grpcCodes) {
+		return strconv.Itoa(code)
+	}
+	return grpcCodes[code]
+}
+
+// rawStatus returns the grpc-status sent by the onion, empty if none
+func (c *grpcCall) rawStatus() string {
+	status := c.header.Get("Grpc-Status")
+	if status == "" {
+		status = c.header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if status == "" {
+		status = c.responses.trailerStatus()
+	}
+	return status
+}
+
+// implemented returns true if the onion answered the call with a status other than UNIMPLEMENTED,
+// ie. the method exists and is not made up by the client
+func (c *grpcCall) implemented() bool {
+	return c.rawStatus() != "" && c.Status() != "UNIMPLEMENTED"
+}
+
+// Messages returns the number of messages sent by the client and by the onion
+func (c *grpcCall) Messages() (uint64, uint64) {
+	return c.requests.count(), c.responses.count()
+}
+
+// grpcFrameCounter counts the length-prefixed messages of a gRPC stream
+// the gRPC-Web trailers, flagged with 0x80, are not counted but kept to read the status
+type grpcFrameCounter struct {
+	mu       sync.Mutex
+	header   [5]byte
+	read     int
+	left     uint32
+	trailer  bool
+	trailers []byte
+	messages uint64
+}
+
+// maxGRPCWebTrailers bounds the trailers kept by grpcFrameCounter
+const maxGRPCWebTrailers = 4096
+
+func (c *grpcFrameCounter) write(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(b) > 0 {
+		if c.left == 0 && c.read < len(c.header) {
+			n := copy(c.header[c.read:], b)
+			c.read += n
+			b = b[n:]
+			if c.read < len(c.header) {
+				return
+			}
+
+			c.trailer = c.header[0]&0x80 != 0
+			c.left = binary.BigEndian.Uint32(c.header[1:])
+			if !c.trailer {
+				atomic.AddUint64(&c.messages, 1)
+			}
+			if c.left == 0 {
+				c.read = 0
+			}
+			continue
+		}
+
+		n := uint32(len(b))
+		if n > c.left {
+			n = c.left
+		}
+		if c.trailer && len(c.trailers)+int(n) <= maxGRPCWebTrailers {
+			c.trailers = append(c.trailers, b[:n]...)
+		}
+		c.left -= n
+		b = b[n:]
+		if c.left == 0 {
+			c.read = 0
+		}
+	}
+}
+
+func (c *grpcFrameCounter) count() uint64 {
+	return atomic.LoadUint64(&c.messages)
+}
+
+// trailerStatus returns the grpc-status of the gRPC-Web trailers, if any
+func (c *grpcFrameCounter) trailerStatus() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, line := range strings.Split(string(c.trailers), "\r\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		if textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i])) == "Grpc-Status" {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// grpcBody counts the messages of the request, possibly read by the goroutine of the transport
+type grpcBody struct {
+	io.ReadCloser
+	counter *grpcFrameCounter
+}
+
+func (b *grpcBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.counter.write(p[:n])
+	return n, err
+}
+
+// grpcResponseWriter counts the messages of the response
+type grpcResponseWriter struct {
+	http.ResponseWriter
+	counter *grpcFrameCounter
+}
+
+func (w *grpcResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.counter.write(b[:n])
+	return n, err
+}
+
+// Flush is required to stream the responses, eg. gRPC server streams
+func (w *grpcResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
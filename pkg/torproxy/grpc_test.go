@@ -0,0 +1,171 @@
+package torproxy_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	grpcService = "tdex.v1.TradeService"
+	grpcMethod  = "TradePropose"
+)
+
+// grpcFrame returns a length-prefixed gRPC message, or gRPC-Web trailers with the 0x80 flag
+func grpcFrame(flags byte, payload string) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// grpcOnion answers TradePropose with 3 messages, written in chunks splitting the frames, and FAILED_PRECONDITION
+// gRPC-Web calls get 2 messages and OK in the trailers frame, any other method is UNIMPLEMENTED
+func grpcOnion() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web") {
+			w.Header().Set("Content-Type", "application/grpc-web+proto")
+			w.Write(grpcFrame(0x00, "first"))
+			w.Write(grpcFrame(0x00, "second"))
+			w.Write(grpcFrame(0x80, "grpc-status: 0\r\ngrpc-message: \r\n"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.URL.Path != "/"+grpcService+"/"+grpcMethod {
+			// trailers-only response
+			w.Header().Set("Grpc-Status", "12")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		var body []byte
+		for _, payload := range []string{"first", "second", "third"} {
+			body = append(body, grpcFrame(0x00, payload)...)
+		}
+		for len(body) > 0 {
+			n := 3
+			if n > len(body) {
+				n = len(body)
+			}
+			w.Write(body[:n])
+			w.(http.Flusher).Flush()
+			body = body[n:]
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "9")
+	})
+}
+
+// lineWriter sends every line written by the access log
+type lineWriter chan string
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- strings.TrimSpace(string(b))
+	return len(b), nil
+}
+
+func TestGRPCObservation(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, grpcOnion())
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Pool.Close()
+	metrics := tp.WithMetrics()
+	lines := make(lineWriter, 1)
+	tp.AccessLog = log.New(lines, "", 0)
+	srv := httptest.NewServer(h2c.NewHandler(tp.Handler(), &http2.Server{}))
+	defer srv.Close()
+
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	call := func(client *http.Client, method, contentType string) (*http.Response, string) {
+		t.Helper()
+
+		body := append(grpcFrame(0x00, "request"), grpcFrame(0x00, "request")...)
+		req, err := http.NewRequest(http.MethodPost, srv.URL+route+"/"+grpcService+"/"+method, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		select {
+		case line := <-lines:
+			return res, line
+		case <-time.After(5 * time.Second):
+			t.Fatal("no access log line for the call")
+			return nil, ""
+		}
+	}
+
+	res, line := call(h2cClient, grpcMethod, "application/grpc")
+	if v := res.Trailer.Get("Grpc-Status"); v != "9" {
+		t.Errorf("got grpc-status %q in the trailers, want %q", v, "9")
+	}
+	if !strings.HasSuffix(line, " grpc=tdex.v1.TradeService/TradePropose grpc-status=FAILED_PRECONDITION messages=2/3") {
+		t.Errorf("got access log %q, want the method, status and messages of the call", line)
+	}
+
+	_, line = call(http.DefaultClient, grpcMethod, "application/grpc-web+proto")
+	if !strings.HasSuffix(line, " grpc=tdex.v1.TradeService/TradePropose grpc-status=OK messages=2/2") {
+		t.Errorf("got access log %q for gRPC-Web, want the status of the trailers frame", line)
+	}
+
+	for i := 0; i < 3; i++ {
+		res, line = call(h2cClient, "MadeUp", "application/grpc")
+	}
+	if v := res.Header.Get("Grpc-Status"); v != "12" {
+		t.Errorf("got grpc-status %q in the headers, want %q", v, "12")
+	}
+	if !strings.HasSuffix(line, " grpc=tdex.v1.TradeService/MadeUp grpc-status=UNIMPLEMENTED messages=2/0") {
+		t.Errorf("got access log %q for an unimplemented method, want its name and status", line)
+	}
+
+	scraped := scrape(metrics)
+
+	labels := `method="TradePropose",route="` + route[1:] + `",service="tdex.v1.TradeService"`
+	otherLabels := `method="other",route="` + route[1:] + `",service="other"`
+	for _, want := range []string{
+		`torproxy_grpc_requests_total{code="FAILED_PRECONDITION",` + labels + `} 1`,
+		`torproxy_grpc_requests_total{code="OK",` + labels + `} 1`,
+		`torproxy_grpc_messages_received_total{` + labels + `} 4`,
+		`torproxy_grpc_messages_sent_total{` + labels + `} 5`,
+		// the methods made up by the clients do not take a label
+		`torproxy_grpc_requests_total{code="UNIMPLEMENTED",` + otherLabels + `} 3`,
+	} {
+		if !strings.Contains(scraped, want+"\n") {
+			t.Errorf("metric %s not found", want)
+		}
+	}
+	if strings.Contains(scraped, `method="MadeUp"`) {
+		t.Error("got the unimplemented method labelled, want it as other")
+	}
+}
@@ -0,0 +1,144 @@
+package torproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HeaderPolicy defines which client-identifying headers are forwarded to the onion operators
+// the zero value strips all of them, see PrivacyHeaderPolicy
+type HeaderPolicy struct {
+	// ForwardClientIP appends the client IP to X-Forwarded-For and keeps Forwarded and X-Real-IP
+	ForwardClientIP bool
+	// PseudonymizeClientIP sends a stable pseudonym of the client IP as RFC 7239 obfuscated identifier
+	// in the Forwarded header, ignored if ForwardClientIP is true
+	PseudonymizeClientIP bool
+	// ForwardHost sets X-Forwarded-Host with the host requested by the client
+	ForwardHost bool
+	// ForwardUserAgent keeps the User-Agent of the client
+	ForwardUserAgent bool
+	// ForwardCookies keeps the Cookie header of the client
+	ForwardCookies bool
+	// ForwardFingerprinting keeps Via, Referer, Accept-Language, client hints and other fingerprinting headers
+	ForwardFingerprinting bool
+	// Remove lists additional headers to strip from the requests
+	Remove []string
+}
+
+// PrivacyHeaderPolicy returns the default policy stripping every client-identifying header
+func PrivacyHeaderPolicy() *HeaderPolicy {
+	return &HeaderPolicy{}
+}
+
+// TransparentHeaderPolicy returns a policy forwarding the client headers as a classic reverse proxy
+func TransparentHeaderPolicy() *HeaderPolicy {
+	return &HeaderPolicy{
+		ForwardClientIP:       true,
+		ForwardHost:           true,
+		ForwardUserAgent:      true,
+		ForwardCookies:        true,
+		ForwardFingerprinting: true,
+	}
+}
+
+// ParseHeaderPolicy returns the HeaderPolicy preset matching the given name
+func ParseHeaderPolicy(name string) (*HeaderPolicy, error) {
+	switch name {
+	case "", "privacy":
+		return PrivacyHeaderPolicy(), nil
+	case "pseudonymous":
+		return &HeaderPolicy{PseudonymizeClientIP: true}, nil
+	case "transparent":
+		return TransparentHeaderPolicy(), nil
+	default:
+		return nil, fmt.Errorf("unknown header policy %q", name)
+	}
+}
+
+// clientIPHeaders carry the address of the client or of the proxies in between
+var clientIPHeaders = []string{
+	"X-Forwarded-For",
+	"Forwarded",
+	"X-Real-Ip",
+	"True-Client-Ip",
+	"Cf-Connecting-Ip",
+	"X-Client-Ip",
+	"X-Cluster-Client-Ip",
+}
+
+// fingerprintingHeaders help identify a client across requests
+var fingerprintingHeaders = []string{
+	"Via",
+	"Referer",
+	"Accept-Language",
+	"Dnt",
+	"X-Requested-With",
+}
+
+// fingerprintingPrefixes are the prefixes of client hints and fetch metadata headers
+var fingerprintingPrefixes = []string{
+	"Sec-Ch-",
+	"Sec-Fetch-",
+}
+
+// pseudonymKey is the per-process secret to derive the client IP pseudonyms
+var pseudonymKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// apply strips the headers of req according to the policy
+func (p *HeaderPolicy) apply(req *http.Request) {
+	if !p.ForwardClientIP {
+		for _, h := range clientIPHeaders {
+			req.Header.Del(h)
+		}
+		if p.PseudonymizeClientIP {
+			if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+				req.Header.Set("Forwarded", fmt.Sprintf("for=\"_%s\"", pseudonym(clientIP)))
+			}
+		}
+	}
+
+	if !p.ForwardUserAgent {
+		// an empty User-Agent also prevents the std lib from setting its default value
+		req.Header.Set("User-Agent", "")
+	}
+
+	if !p.ForwardCookies {
+		req.Header.Del("Cookie")
+	}
+
+	if !p.ForwardFingerprinting {
+		for _, h := range fingerprintingHeaders {
+			req.Header.Del(h)
+		}
+		for h := range req.Header {
+			for _, prefix := range fingerprintingPrefixes {
+				if strings.HasPrefix(h, prefix) {
+					req.Header.Del(h)
+				}
+			}
+		}
+	}
+
+	for _, h := range p.Remove {
+		req.Header.Del(h)
+	}
+}
+
+// pseudonym returns a stable obfuscated identifier for the given client IP
+func pseudonym(clientIP string) string {
+	mac := hmac.New(sha256.New, pseudonymKey)
+	mac.Write([]byte(clientIP))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
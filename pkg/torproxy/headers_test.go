@@ -0,0 +1,126 @@
+package torproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// route is the path prefix of the test onion on the proxy
+const route = "/torproxytestonionserviceaaaatorproxytestonionserviceaaaa"
+
+// clientHeaders are sent by the test client, X-Custom is never stripped and X-Debug-Token only when listed in Remove
+var clientHeaders = map[string]string{
+	"X-Forwarded-For": "203.0.113.7",
+	"Forwarded":       "for=203.0.113.7",
+	"X-Real-Ip":       "203.0.113.7",
+	"User-Agent":      "secret-agent/1.0",
+	"Cookie":          "session=1",
+	"Referer":         "https://example.com/",
+	"Accept-Language": "it-IT",
+	"Sec-Ch-Ua":       `"Chromium";v="100"`,
+	"Sec-Fetch-Site":  "cross-site",
+	"X-Debug-Token":   "token",
+	"X-Custom":        "kept",
+}
+
+// forwardedHeaders proxies a request with clientHeaders through a proxy applying the policy
+// and returns the headers received by the onion
+func forwardedHeaders(t *testing.T, policy *torproxy.HeaderPolicy) http.Header {
+	t.Helper()
+
+	received := make(chan http.Header, 1)
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Pool.Close()
+	tp.HeaderPolicy = policy
+	srv := httptest.NewServer(tp.Handler())
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+route+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range clientHeaders {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	return <-received
+}
+
+func TestPrivacyHeaderPolicy(t *testing.T) {
+	header := forwardedHeaders(t, nil)
+
+	for k := range clientHeaders {
+		if k == "X-Custom" || k == "X-Debug-Token" {
+			continue
+		}
+		if v := header.Get(k); v != "" {
+			t.Errorf("got %s: %s forwarded, want it stripped", k, v)
+		}
+	}
+	if v := header.Get("X-Forwarded-Host"); v != "" {
+		t.Errorf("got X-Forwarded-Host: %s forwarded, want it stripped", v)
+	}
+	if v := header.Get("X-Custom"); v != "kept" {
+		t.Errorf("got X-Custom: %q, want %q", v, "kept")
+	}
+}
+
+func TestPseudonymousHeaderPolicy(t *testing.T) {
+	policy, err := torproxy.ParseHeaderPolicy("pseudonymous")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := forwardedHeaders(t, policy).Get("Forwarded")
+	second := forwardedHeaders(t, policy).Get("Forwarded")
+
+	if !strings.HasPrefix(first, `for="_`) || strings.Contains(first, "127.0.0.1") {
+		t.Fatalf("got Forwarded: %s, want an obfuscated identifier", first)
+	}
+	if first != second {
+		t.Fatalf("got pseudonyms %s and %s for the same client, want a stable one", first, second)
+	}
+}
+
+func TestTransparentHeaderPolicy(t *testing.T) {
+	policy := torproxy.TransparentHeaderPolicy()
+	policy.Remove = []string{"X-Debug-Token"}
+	header := forwardedHeaders(t, policy)
+
+	if v := header.Get("X-Forwarded-For"); v != "203.0.113.7, 127.0.0.1" {
+		t.Errorf("got X-Forwarded-For: %q, want the client IP appended", v)
+	}
+	if v := header.Get("X-Forwarded-Host"); !strings.HasPrefix(v, "127.0.0.1:") {
+		t.Errorf("got X-Forwarded-Host: %q, want the host requested by the client", v)
+	}
+	for _, k := range []string{"User-Agent", "Cookie", "Referer", "Sec-Ch-Ua"} {
+		if v := header.Get(k); v != clientHeaders[k] {
+			t.Errorf("got %s: %q, want %q", k, v, clientHeaders[k])
+		}
+	}
+	if v := header.Get("X-Debug-Token"); v != "" {
+		t.Errorf("got X-Debug-Token: %s forwarded, want it removed", v)
+	}
+}
@@ -0,0 +1,102 @@
+package torproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostRoutingOptions defines the base domains under which each onion is served at the root path
+// eg. with base domain proxy.example.com, <just_onion_host_without_dot_onion>.proxy.example.com/<path> is proxied to <onion>/<path>
+// useful for clients, like gRPC ones, not able to add a path prefix
+type HostRoutingOptions struct {
+	BaseDomains []string
+	// Aliases maps a DNS label to an onion host, eg. provider -> <onion>.onion:80
+	// aliases can also be given in the registry with the "alias" field of an endpoint
+	Aliases map[string]string
+}
+
+// hostRouter routes the requests according to the Host header, falling back to the path based router
+type hostRouter struct {
+	baseDomains []string
+	aliases     map[string]string
+	hosts       map[string]http.Handler
+	fallback    http.Handler
+}
+
+func newHostRouter(options *HostRoutingOptions, aliases map[string]string, hosts map[string]http.Handler, fallback http.Handler) *hostRouter {
+	baseDomains := make([]string, 0, len(options.BaseDomains))
+	for _, d := range options.BaseDomains {
+		baseDomains = append(baseDomains, strings.ToLower(strings.Trim(d, ".")))
+	}
+
+	return &hostRouter{
+		baseDomains: baseDomains,
+		aliases:     aliases,
+		hosts:       hosts,
+		fallback:    fallback,
+	}
+}
+
+func (h *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := h.route(r.Host); ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	h.fallback.ServeHTTP(w, r)
+}
+
+// route returns the handler of the onion matching the subdomain of the host, if any
+func (h *hostRouter) route(host string) (http.Handler, bool) {
+	if hostWithoutPort, _, err := net.SplitHostPort(host); err == nil {
+		host = hostWithoutPort
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, base := range h.baseDomains {
+		if !strings.HasSuffix(host, "."+base) {
+			continue
+		}
+
+		label := strings.TrimSuffix(host, "."+base)
+		if strings.Contains(label, ".") {
+			continue
+		}
+		if onion, ok := h.aliases[label]; ok {
+			label = onion
+		}
+
+		handler, ok := h.hosts[label]
+		return handler, ok
+	}
+
+	return nil, false
+}
+
+// aliases returns the aliases of the registry and of the host routing options, keyed by label
+// the values are the onion hosts without .onion and port, as the keys of the host router
+func (tp *TorProxy) aliases() map[string]string {
+	aliases := make(map[string]string, len(tp.registryAliases))
+	for label, onion := range tp.registryAliases {
+		aliases[label] = onion
+	}
+	if tp.HostRouting != nil {
+		for label, onion := range tp.HostRouting.Aliases {
+			aliases[strings.ToLower(label)] = withoutOnion(onion)
+		}
+	}
+	return aliases
+}
+
+// hostRoutingDecision approves on-demand certificates for the names routed to an onion
+func (tp *TorProxy) hostRoutingDecision(name string) error {
+	router, ok := tp.hostRouter.Load().(*hostRouter)
+	if !ok || router == nil {
+		return fmt.Errorf("%s is not routed to any onion", name)
+	}
+	if _, ok := router.route(name); !ok {
+		return fmt.Errorf("%s is not routed to any onion", name)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package torproxy_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tdex-network/tor-proxy/pkg/registry"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+const (
+	// secondOnionHost is a v2 onion, aliased in the registry
+	secondOnionHost = "torproxytestbbbb.onion"
+	baseDomain      = "proxy.example.com"
+)
+
+func TestHostRouting(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	for _, host := range []string{onionHost, secondOnionHost} {
+		host := host
+		socks.AddOnion(host, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s%s", host, r.URL.Path)
+		}))
+	}
+
+	reg, err := registry.NewRegistry(fmt.Sprintf(
+		`[{"endpoint": %q}, {"endpoint": "http://%s:80", "alias": "market"}]`, endpoint, secondOnionHost,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := torproxy.NewPool([]*torproxy.TorClient{socks.TorClient()}, torproxy.RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	tp := torproxy.NewTorProxyWithDialer(pool)
+	if err := tp.WithRegistry(reg); err != nil {
+		t.Fatal(err)
+	}
+	tp.HostRouting = &torproxy.HostRoutingOptions{
+		BaseDomains: []string{baseDomain + "."},
+		Aliases:     map[string]string{"Provider": onionHost + ":80"},
+	}
+	srv := httptest.NewServer(tp.Handler())
+	defer srv.Close()
+
+	tests := []struct {
+		host   string
+		path   string
+		status int
+		body   string
+	}{
+		// the onion is served at the root path
+		{route[1:] + "." + baseDomain, "/v1/market", http.StatusOK, onionHost + "/v1/market"},
+		{route[1:] + "." + baseDomain + ":443", "/", http.StatusOK, onionHost + "/"},
+		{"TORPROXYTESTBBBB." + baseDomain, "/v1/market", http.StatusOK, secondOnionHost + "/v1/market"},
+		// the readiness of the proxy is served on the admin listener only
+		{route[1:] + "." + baseDomain, torproxy.ReadinessPath, http.StatusOK, onionHost + torproxy.ReadinessPath},
+		// aliases of the options and of the registry
+		{"provider." + baseDomain, "/v1/market", http.StatusOK, onionHost + "/v1/market"},
+		{"market." + baseDomain, "/v1/market", http.StatusOK, secondOnionHost + "/v1/market"},
+		// the other hosts fall back to the path based routes
+		{"unknown." + baseDomain, route + "/v1/market", http.StatusOK, onionHost + "/v1/market"},
+		{"api.provider." + baseDomain, "/v1/market", http.StatusNotFound, ""},
+		{"provider.example.net", "/v1/market", http.StatusNotFound, ""},
+		{baseDomain, route + "/", http.StatusOK, onionHost + "/"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%s%s: got status %d, want %d", tt.host, tt.path, res.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && string(body) != tt.body {
+			t.Errorf("%s%s: got %q from the onion, want %q", tt.host, tt.path, body, tt.body)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+//go:build http3
+// +build http3
+
+package torproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// quicServer serves HTTP/3 with quic-go
+type quicServer struct {
+	server *http3.Server
+	conn   net.PacketConn
+}
+
+// listenHTTP3 listens for QUIC on the UDP port of the given address
+func listenHTTP3(address string, tlsConfig *tls.Config, handler http.Handler) (http3Server, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http3.Server{
+		Addr:      address,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	return &quicServer{server: server, conn: conn}, nil
+}
+
+func (s *quicServer) Serve() error {
+	return s.server.Serve(s.conn)
+}
+
+// SetAltSvc leaves the header unchanged until the server listens, quic-go has no port to advertise before
+func (s *quicServer) SetAltSvc(header http.Header) {
+	s.server.SetQuicHeaders(header)
+}
+
+func (s *quicServer) Close() error {
+	if err := s.server.Close(); err != nil {
+		return err
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,14 @@
+//go:build !http3
+// +build !http3
+
+package torproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// listenHTTP3 fails, the binary must be built with -tags http3 to serve HTTP/3
+func listenHTTP3(address string, tlsConfig *tls.Config, handler http.Handler) (http3Server, error) {
+	return nil, ErrHTTP3NotSupported
+}
@@ -0,0 +1,64 @@
+package torproxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// serveHTTPRedirect listens on the given address for plain HTTP requests
+// ACME HTTP-01 challenges are answered via certmagic if acme is given, everything else is redirected to HTTPS
+// it reads the PROXY protocol headers as the HTTPS listener, if enabled
+func serveHTTPRedirect(address, httpsAddress string, acme *certmagic.ACMEManager, proxyProtocol *ProxyProtocolOptions) (*http.Server, net.Listener, error) {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proxyProtocol != nil {
+		lis = proxyProtocol.wrap(lis)
+	}
+	lis = &onceCloseListener{Listener: lis}
+
+	_, httpsPort, _ := net.SplitHostPort(httpsAddress)
+	var handler http.Handler = redirectToHTTPS(httpsPort)
+	if acme != nil {
+		handler = acme.HTTPChallengeHandler(handler)
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		IdleTimeout:       5 * time.Second,
+	}
+	go srv.Serve(lis)
+
+	return srv, lis, nil
+}
+
+// redirectToHTTPS redirects the requests to the same host and path on the given HTTPS port
+func redirectToHTTPS(httpsPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		// GET and HEAD can be safely turned into GET by clients, others keep the method and body
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, target, code)
+	}
+}
@@ -0,0 +1,466 @@
+package torproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ListenerOptions defines a listener serving the routing table of the proxy
+// Network is either tcp (default) or unix, in which case Address is the path of the socket
+// TLS is enabled if a non-nil *TLSOptions is given
+type ListenerOptions struct {
+	Network string
+	Address string
+	TLS     *TLSOptions
+	// HTTP3 also serves HTTP/3 on the UDP port of Address, advertised with Alt-Svc on the TLS responses
+	// it requires TLS and a binary built with -tags http3
+	HTTP3 bool
+	// ProxyProtocol enables reading the client address from PROXY protocol headers, disabled if nil
+	ProxyProtocol *ProxyProtocolOptions
+}
+
+// ErrHTTP3NotSupported is returned when serving HTTP/3 with a binary built without -tags http3
+var ErrHTTP3NotSupported = errors.New("HTTP/3 not supported, build with -tags http3")
+
+// http3Server serves HTTP/3 on a UDP port
+type http3Server interface {
+	Serve() error
+	// SetAltSvc advertises the HTTP/3 endpoint in the given response header
+	SetAltSvc(header http.Header)
+	Close() error
+}
+
+// ServeListeners serves the same routing table on all the given listeners and on the onion service, if any
+// it blocks until one of the listeners fails or the proxy is shut down, in which case nil is returned
+func (tp *TorProxy) ServeListeners(listeners []*ListenerOptions) error {
+	if len(listeners) == 0 && tp.OnionService == nil {
+		return errors.New("an address to listen is required if not serving on an onion service")
+	}
+
+	for _, options := range listeners {
+		lis, err := tp.listen(options)
+		if err != nil {
+			tp.closeListeners()
+			return fmt.Errorf("listening on %s: %w", options.Address, err)
+		}
+
+		// Set address and listener
+		if tp.Listener == nil {
+			tp.Address = options.Address
+			tp.Listener = lis
+		}
+		tp.Listeners = append(tp.Listeners, lis)
+
+		// Set with TLS stuff
+		if options.TLS != nil {
+			tp.Domains = options.TLS.Domains
+			tp.useTLS = true
+		}
+	}
+
+	// Now we can reverse proxy all the redirects through the pool of socks5 backends
+	handler := tp.Handler()
+
+	errChan := make(chan error, 2*len(tp.Listeners)+1)
+	for i, lis := range tp.Listeners {
+		srv, lisHandler := &http.Server{}, handler
+		if tlsLis, ok := lis.(*tlsListener); ok {
+			if tlsLis.http3 {
+				h3, err := listenHTTP3(tlsLis.address, tlsLis.config, handler)
+				if err != nil {
+					tp.closeListeners()
+					return fmt.Errorf("listening HTTP/3 on %s: %w", tlsLis.address, err)
+				}
+				tp.http3Servers = append(tp.http3Servers, h3)
+				lisHandler = withAltSvc(h3, handler)
+				go func() {
+					errChan <- h3.Serve()
+				}()
+			}
+		} else {
+			// the plaintext listeners accept HTTP/2 cleartext too, either with prior knowledge or upgrade, for gRPC clients
+			var err error
+			if lisHandler, err = h2cHandler(srv, handler); err != nil {
+				tp.closeListeners()
+				return err
+			}
+		}
+		srv.Handler = lisHandler
+
+		// both the server and Close may close the listener
+		lis = &onceCloseListener{Listener: lis}
+		tp.Listeners[i] = lis
+		if !tp.serve(srv, lis, errChan) {
+			for _, lis := range tp.Listeners[i+1:] {
+				lis.Close()
+			}
+			return nil
+		}
+	}
+	if len(tp.Listeners) > 0 {
+		tp.Listener = tp.Listeners[0]
+	}
+	if tp.OnionService != nil {
+		srv := &http.Server{}
+		onionHandler, err := h2cHandler(srv, handler)
+		if err != nil {
+			return err
+		}
+		srv.Handler = onionHandler
+
+		tp.OnionService.Listener = &onceCloseListener{Listener: tp.Metrics.listener(tp.OnionService.Listener, "onion")}
+		if !tp.serve(srv, tp.OnionService.Listener, errChan) {
+			return nil
+		}
+	}
+
+	if err := <-errChan; err != nil && tp.Ready() {
+		return err
+	}
+	return nil
+}
+
+// closeListeners closes the listeners opened by ServeListeners so far, when one of them fails
+// the ports are released for the caller to try again
+func (tp *TorProxy) closeListeners() {
+	for _, lis := range tp.Listeners {
+		lis.Close()
+	}
+	for _, h3 := range tp.http3Servers {
+		h3.Close()
+	}
+	if tp.HTTPListener != nil {
+		tp.HTTPListener.Close()
+	}
+	tp.Listener, tp.Listeners, tp.http3Servers, tp.HTTPListener = nil, nil, nil, nil
+}
+
+// serve serves the listener with the given server, unless the proxy is already shutting down
+func (tp *TorProxy) serve(srv *http.Server, lis net.Listener, errChan chan<- error) bool {
+	if !tp.trackServer(srv) {
+		lis.Close()
+		return false
+	}
+	go func() {
+		errChan <- srv.Serve(lis)
+	}()
+	return true
+}
+
+// h2cHandler serves HTTP/2 cleartext with the given handler
+// the HTTP/2 server is bound to srv, so that shutting down srv sends a GOAWAY to the h2c connections as well
+func h2cHandler(srv *http.Server, handler http.Handler) (http.Handler, error) {
+	h2s := &http2.Server{}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, fmt.Errorf("configuring HTTP/2: %w", err)
+	}
+	return h2c.NewHandler(handler, h2s), nil
+}
+
+// listen returns the listener for the given options, wrapped with TLS if enabled
+func (tp *TorProxy) listen(options *ListenerOptions) (net.Listener, error) {
+	network := options.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	if network == "unix" {
+		// remove a stale socket left by a previous run
+		if err := os.Remove(options.Address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if options.TLS == nil && options.HTTP3 {
+		return nil, errors.New("HTTP/3 requires TLS")
+	}
+
+	var tlsConfig *tls.Config
+	if options.TLS != nil {
+		var err error
+		if tlsConfig, err = tp.tlsConfig(options.Address, options.TLS, options.ProxyProtocol); err != nil {
+			return nil, err
+		}
+	}
+
+	lis, err := net.Listen(network, options.Address)
+	if err != nil {
+		return nil, err
+	}
+	lis = tp.Metrics.listener(lis, options.Address)
+
+	// the PROXY header precedes the TLS handshake
+	if options.ProxyProtocol != nil {
+		lis = options.ProxyProtocol.wrap(lis)
+	}
+
+	if tlsConfig == nil {
+		return lis, nil
+	}
+
+	// get a TLS listener
+	return &tlsListener{
+		Listener: tls.NewListener(lis, tlsConfig),
+		address:  options.Address,
+		config:   tlsConfig,
+		http3:    options.HTTP3 && network == "tcp",
+	}, nil
+}
+
+// tlsListener marks the listeners serving TLS, the other ones serve HTTP/2 cleartext too
+// the TLS configuration is shared with the HTTP/3 server, if any
+type tlsListener struct {
+	net.Listener
+	address string
+	config  *tls.Config
+	http3   bool
+}
+
+// withAltSvc advertises the HTTP/3 server in the responses of the handler
+func withAltSvc(h3 http3Server, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetAltSvc(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// tlsConfig returns the TLS configuration for the listener on the given address
+// if key and certificate filesystem paths are given they are used, otherwise CertMagic obtains the certificates for the domains
+func (tp *TorProxy) tlsConfig(address string, options *TLSOptions, proxyProtocol *ProxyProtocolOptions) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+
+	// if key and certificate filesystem paths are given, do NOT use certmagic.
+	if len(options.TLSKey) > 0 && len(options.TLSCert) > 0 {
+		loader, err := NewCertificateLoader(options.TLSCert, options.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		// rotated files are picked up without restarting, see ReloadCertificates
+		loader.Watch(options.CertWatchPeriod)
+		tp.certLoadersMu.Lock()
+		tp.certLoaders = append(tp.certLoaders, loader)
+		tp.certLoadersMu.Unlock()
+
+		tlsConfig = &tls.Config{
+			GetCertificate: loader.GetCertificate,
+		}
+		tlsConfig.Rand = rand.Reader
+		options.tlsPolicy().apply(tlsConfig)
+		if options.ClientAuth != nil {
+			if err := options.ClientAuth.apply(tlsConfig); err != nil {
+				return nil, err
+			}
+		}
+
+		if options.HTTPAddress != "" {
+			if err := tp.listenHTTPRedirect(options.HTTPAddress, address, nil, proxyProtocol); err != nil {
+				return nil, err
+			}
+		}
+
+		return tlsConfig, nil
+	}
+
+	magic, acmeManager := tp.certmagicConfig(options)
+
+	// the HTTP listener must be up before obtaining certificates to solve HTTP-01 challenges
+	if options.HTTPAddress != "" {
+		if err := tp.listenHTTPRedirect(options.HTTPAddress, address, acmeManager, proxyProtocol); err != nil {
+			return nil, err
+		}
+	}
+
+	// config, with on-demand TLS the domains are obtained at the first handshake
+	if err := magic.ManageSync(context.Background(), options.Domains); err != nil {
+		return nil, err
+	}
+	tlsConfig = magic.TLSConfig()
+	options.tlsPolicy().apply(tlsConfig)
+	if options.ClientAuth != nil {
+		acmeConfig := tlsConfig.Clone()
+		if err := options.ClientAuth.apply(tlsConfig); err != nil {
+			return nil, err
+		}
+		// the CA solving TLS-ALPN challenges has no client certificate
+		tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acmez.ACMETLS1Protocol {
+					return acmeConfig, nil
+				}
+			}
+			return nil, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// certmagicConfig returns a CertMagic config of its own for the given options, the global defaults are never mutated
+// several proxies sharing the same Storage share the certificates and the ACME account
+func (tp *TorProxy) certmagicConfig(options *TLSOptions) (*certmagic.Config, *certmagic.ACMEManager) {
+	var magic *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return magic, nil
+		},
+	})
+	tp.certCaches = append(tp.certCaches, cache)
+
+	magic = certmagic.New(cache, certmagic.Config{
+		Storage: options.storage(),
+	})
+
+	if options.OnDemand {
+		decisionFunc := options.decisionFunc()
+		// subdomains routed to an onion are approved too
+		if tp.HostRouting != nil && options.DecisionFunc == nil {
+			allowlist := decisionFunc
+			decisionFunc = func(name string) error {
+				if err := allowlist(name); err == nil {
+					return nil
+				}
+				return tp.hostRoutingDecision(name)
+			}
+		}
+		magic.OnDemand = &certmagic.OnDemandConfig{DecisionFunc: decisionFunc}
+	}
+
+	template := certmagic.ACMEManager{
+		// read and agree to your CA's legal documents
+		Agreed:       true,
+		Email:        options.Email,
+		CA:           certmagic.LetsEncryptProductionCA,
+		TrustedRoots: options.CARoots,
+		// HTTP-01 challenges are solved only if we listen for plain HTTP
+		DisableHTTPChallenge: options.HTTPAddress == "",
+	}
+	// use the staging endpoint while we're developing
+	if options.UseStaging {
+		template.CA = certmagic.LetsEncryptStagingCA
+	}
+	if len(options.CA) > 0 {
+		template.CA = options.CA
+	}
+	if len(options.EABKeyID) > 0 {
+		template.ExternalAccount = &acme.EAB{
+			KeyID:  options.EABKeyID,
+			MACKey: options.EABMACKey,
+		}
+	}
+	if options.DNSProvider != nil {
+		template.DNS01Solver = &certmagic.DNS01Solver{DNSProvider: options.DNSProvider}
+	}
+	if _, port, err := net.SplitHostPort(options.HTTPAddress); err == nil && port != "80" {
+		template.AltHTTPPort, _ = strconv.Atoi(port)
+	}
+
+	acmeManager := certmagic.NewACMEManager(magic, template)
+	magic.Issuers = []certmagic.Issuer{acmeManager}
+
+	return magic, acmeManager
+}
+
+// storage returns the certificate storage of the options
+func (o *TLSOptions) storage() certmagic.Storage {
+	if o.Storage != nil {
+		return o.Storage
+	}
+	if len(o.StorageDir) > 0 {
+		return &certmagic.FileStorage{Path: o.StorageDir}
+	}
+	return certmagic.Default.Storage
+}
+
+// ReloadCertificates reloads the key pairs of the TLS listeners using filesystem paths
+// the current pair of a listener is kept if the new one is not valid, the other listeners are reloaded anyway
+func (tp *TorProxy) ReloadCertificates() error {
+	var errs []string
+	for _, loader := range tp.loaders() {
+		if err := loader.Reload(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", loader.CertFile, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("reloading certificates: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// loaders returns the certificate loaders of the TLS listeners, they are added while listening
+func (tp *TorProxy) loaders() []*CertificateLoader {
+	tp.certLoadersMu.Lock()
+	defer tp.certLoadersMu.Unlock()
+	return append([]*CertificateLoader(nil), tp.certLoaders...)
+}
+
+// CertificateExpiry returns the earliest expiration time among the certificates loaded from the filesystem
+// the zero time is returned if there are none
+func (tp *TorProxy) CertificateExpiry() time.Time {
+	var expiry time.Time
+	for _, loader := range tp.loaders() {
+		if notAfter := loader.NotAfter(); expiry.IsZero() || notAfter.Before(expiry) {
+			expiry = notAfter
+		}
+	}
+	return expiry
+}
+
+// ListenAdmin serves the readiness and, if enabled, the metrics on the given address
+// it is meant for the internal network only, the routes of the proxy are not served on it
+func (tp *TorProxy) ListenAdmin(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ReadinessPath, tp.serveReadiness)
+	if tp.Metrics != nil {
+		mux.Handle(MetricsPath, tp.Metrics.Handler())
+	}
+
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	lis = &onceCloseListener{Listener: lis}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	if !tp.trackServer(srv) {
+		return lis.Close()
+	}
+	go srv.Serve(lis)
+
+	tp.AdminListener = lis
+	return nil
+}
+
+// listenHTTPRedirect starts the plain HTTP listener, only the first TLS listener asking for it gets one
+func (tp *TorProxy) listenHTTPRedirect(address, httpsAddress string, acme *certmagic.ACMEManager, proxyProtocol *ProxyProtocolOptions) error {
+	if tp.HTTPListener != nil {
+		return nil
+	}
+
+	srv, lis, err := serveHTTPRedirect(address, httpsAddress, acme, proxyProtocol)
+	if err != nil {
+		return err
+	}
+	if !tp.trackServer(srv) {
+		return srv.Close()
+	}
+
+	log.Printf("Serving HTTP to HTTPS redirect on %s\n", address)
+	tp.HTTPListener = lis
+	return nil
+}
@@ -0,0 +1,218 @@
+package torproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// writeCertificate writes the PEM certificate and key files in the directory, returning their paths
+func writeCertificate(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	t.Helper()
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// freeAddress returns a localhost address no one listens on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func TestServeListenersAddressInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeCertificate(t, dir, newTestCA(t).issue(t, "localhost", time.Now().Add(24*time.Hour), "localhost"))
+
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inUse.Close()
+
+	plaintext, tlsAddress, httpAddress := freeAddress(t), freeAddress(t), freeAddress(t)
+	err = tp.ServeListeners([]*torproxy.ListenerOptions{
+		{Address: plaintext},
+		{Address: tlsAddress, TLS: &torproxy.TLSOptions{TLSCert: certPath, TLSKey: keyPath, HTTPAddress: httpAddress}},
+		{Address: inUse.Addr().String()},
+	})
+	if err == nil || !strings.Contains(err.Error(), "listening on "+inUse.Addr().String()) {
+		t.Fatalf("got error %v, want the address in use refused", err)
+	}
+
+	// the listeners opened before the failure are closed, the ports can be bound again
+	for _, address := range []string{plaintext, tlsAddress, httpAddress} {
+		lis, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Errorf("%s is still in use after the failure: %v", address, err)
+			continue
+		}
+		lis.Close()
+	}
+	if tp.Listener != nil || len(tp.Listeners) != 0 || tp.HTTPListener != nil {
+		t.Errorf("got the closed listeners still set on the proxy")
+	}
+}
+
+func TestServeListenersH2C(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	grpc := grpcOnion()
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpc.ServeHTTP(w, r)
+			return
+		}
+		fmt.Fprint(w, "proxied")
+	}))
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+
+	address := freeAddress(t)
+	go tp.ServeListeners([]*torproxy.ListenerOptions{{Address: address}})
+	waitListening(t, address)
+	url := "http://" + address + route
+
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	// HTTP/1.1 and HTTP/2 with prior knowledge are served on the same listener
+	for _, client := range []*http.Client{http.DefaultClient, h2cClient} {
+		res, err := client.Get(url + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != "proxied" {
+			t.Errorf("%s: got status %d and body %q, want the onion response", res.Proto, res.StatusCode, body)
+		}
+	}
+
+	// the gRPC trailers are preserved
+	body := grpcFrame(0x00, "request")
+	req, err := http.NewRequest(http.MethodPost, url+"/"+grpcService+"/"+grpcMethod, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	res, err := h2cClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("got the gRPC call served over %s, want HTTP/2", res.Proto)
+	}
+	if v := res.Trailer.Get("Grpc-Status"); v != "9" {
+		t.Errorf("got grpc-status %q in the trailers, want %q", v, "9")
+	}
+
+	// the upgrade from HTTP/1.1
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n", route, address)
+	br := bufio.NewReader(conn)
+	upgrade, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgrade.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d for the upgrade, want %d", upgrade.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// the response to the upgraded request comes on the stream 1
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, br)
+	if err := framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	var status, data string
+	for data == "" {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading the upgraded response: %v", err)
+		}
+		switch f := frame.(type) {
+		case *http2.HeadersFrame:
+			fields, err := hpack.NewDecoder(4096, nil).DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range fields {
+				if field.Name == ":status" {
+					status = field.Value
+				}
+			}
+		case *http2.DataFrame:
+			data += string(f.Data())
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		}
+	}
+	if status != "200" || data != "proxied" {
+		t.Errorf("got status %q and body %q for the upgraded request, want the onion response", status, data)
+	}
+}
@@ -0,0 +1,357 @@
+package torproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/proxy"
+)
+
+// MetricsPath serves the Prometheus metrics on the admin listener
+const MetricsPath = "/metrics"
+
+// Metrics holds the Prometheus collectors of a TorProxy, registered on their own registry
+// the routes are labelled with the onion host without .onion, bounded by the registry
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	dialDuration      *prometheus.HistogramVec
+	dialErrors        *prometheus.CounterVec
+	upstreamDuration  *prometheus.HistogramVec
+	requestBytes      *prometheus.CounterVec
+	responseBytes     *prometheus.CounterVec
+	activeStreams     *prometheus.GaugeVec
+	activeConnections *prometheus.GaugeVec
+	registryUpdates   *prometheus.CounterVec
+
+	grpcRequests         *prometheus.CounterVec
+	grpcDuration         *prometheus.HistogramVec
+	grpcMessagesReceived *prometheus.CounterVec
+	grpcMessagesSent     *prometheus.CounterVec
+
+	// grpcMethodsMu guards grpcMethods, the gRPC methods labelled so far by route
+	grpcMethodsMu sync.Mutex
+	grpcMethods   map[string]map[string]bool
+}
+
+// maxGRPCMethods bounds the gRPC methods labelled per route, the next ones are labelled as other
+// only the methods implemented by the onions are labelled, the ones made up by the clients never take a label
+const maxGRPCMethods = 100
+
+// WithMetrics collects the metrics of the proxy, it must be called before serving
+func (tp *TorProxy) WithMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_requests_total",
+			Help: "Requests served, by route and status code.",
+		}, []string{"route", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "torproxy_request_duration_seconds",
+			Help:    "Time to serve the requests, until the end of the response body.",
+			Buckets: torBuckets,
+		}, []string{"route"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "torproxy_tor_dial_duration_seconds",
+			Help:    "Time to open a connection to the onion through tor, circuit included.",
+			Buckets: torBuckets,
+		}, []string{"route"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_tor_dial_errors_total",
+			Help: "Connections to the onions that failed.",
+		}, []string{"route"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "torproxy_upstream_duration_seconds",
+			Help:    "Time from getting a connection to the onion to the first byte of its response.",
+			Buckets: torBuckets,
+		}, []string{"route"}),
+		requestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_request_bytes_total",
+			Help: "Bytes of the request bodies received from the clients.",
+		}, []string{"route"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_response_bytes_total",
+			Help: "Bytes of the response bodies sent to the clients.",
+		}, []string{"route"}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "torproxy_active_streams",
+			Help: "Requests being served, including the gRPC streams.",
+		}, []string{"route"}),
+		activeConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "torproxy_active_connections",
+			Help: "Client connections open, by listener.",
+		}, []string{"listener"}),
+		registryUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_registry_updates_total",
+			Help: "Registry updates by the auto-updater and reloads, by result.",
+		}, []string{"result"}),
+		grpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_grpc_requests_total",
+			Help: "gRPC calls completed, by route, method and final gRPC status.",
+		}, []string{"route", "service", "method", "code"}),
+		grpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "torproxy_grpc_duration_seconds",
+			Help:    "Time to complete the gRPC calls, streams included.",
+			Buckets: torBuckets,
+		}, []string{"route", "service", "method"}),
+		grpcMessagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_grpc_messages_received_total",
+			Help: "gRPC messages received from the clients.",
+		}, []string{"route", "service", "method"}),
+		grpcMessagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "torproxy_grpc_messages_sent_total",
+			Help: "gRPC messages sent to the clients.",
+		}, []string{"route", "service", "method"}),
+		grpcMethods: make(map[string]map[string]bool),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.dialDuration,
+		m.dialErrors,
+		m.upstreamDuration,
+		m.requestBytes,
+		m.responseBytes,
+		m.activeStreams,
+		m.activeConnections,
+		m.registryUpdates,
+		m.grpcRequests,
+		m.grpcDuration,
+		m.grpcMessagesReceived,
+		m.grpcMessagesSent,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "torproxy_routes",
+			Help: "Onions routed by the proxy.",
+		}, func() float64 {
+			tp.configMu.Lock()
+			defer tp.configMu.Unlock()
+			return float64(len(tp.Redirects))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "torproxy_egress_refused_total",
+			Help: "Upstream destinations refused by the egress policy.",
+		}, func() float64 {
+			return float64(tp.egressPolicy().Refused())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "torproxy_tor_backends_healthy",
+			Help: "Tor clients of the pool passing the health checks.",
+		}, func() float64 {
+			if tp.Pool == nil {
+				return 0
+			}
+			return float64(len(tp.Pool.Healthy()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "torproxy_certificate_expiry_timestamp_seconds",
+			Help: "Expiry of the TLS certificate loaded from files expiring first, 0 if none.",
+		}, func() float64 {
+			if expiry := tp.CertificateExpiry(); !expiry.IsZero() {
+				return float64(expiry.Unix())
+			}
+			return 0
+		}),
+	)
+
+	tp.Metrics = m
+	return m
+}
+
+// torBuckets spans the latencies of the onion services, from a cached circuit to a slow rendezvous
+var torBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry returns the registry of the collectors, to register custom ones
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// registryUpdate counts the result of a registry update
+func (m *Metrics) registryUpdate(err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.registryUpdates.WithLabelValues(result).Inc()
+}
+
+// instrument records the requests of the route served by the handler
+func (m *Metrics) instrument(route string, handler http.Handler) http.Handler {
+	if m == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		streams := m.activeStreams.WithLabelValues(route)
+		streams.Inc()
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		// deferred to record the requests aborted by the reverse proxy too
+		defer func() {
+			streams.Dec()
+			m.requests.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+			m.requestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+			m.requestBytes.WithLabelValues(route).Add(float64(atomic.LoadInt64(&body.read)))
+			m.responseBytes.WithLabelValues(route).Add(float64(rec.written))
+			if call := grpcCallFrom(r); call != nil {
+				m.grpcCall(route, call, time.Since(start))
+			}
+		}()
+
+		handler.ServeHTTP(rec, r)
+	})
+}
+
+// grpcCall records a completed gRPC call of the route
+func (m *Metrics) grpcCall(route string, call *grpcCall, duration time.Duration) {
+	service, method := m.grpcMethod(route, call)
+	received, sent := call.Messages()
+
+	m.grpcRequests.WithLabelValues(route, service, method, call.Status()).Inc()
+	m.grpcDuration.WithLabelValues(route, service, method).Observe(duration.Seconds())
+	m.grpcMessagesReceived.WithLabelValues(route, service, method).Add(float64(received))
+	m.grpcMessagesSent.WithLabelValues(route, service, method).Add(float64(sent))
+}
+
+// grpcMethod returns the labels of the method of the call
+// a method is labelled once the onion has answered it with a status other than UNIMPLEMENTED, it is other until then
+// or once maxGRPCMethods methods of the route have been labelled
+func (m *Metrics) grpcMethod(route string, call *grpcCall) (string, string) {
+	m.grpcMethodsMu.Lock()
+	defer m.grpcMethodsMu.Unlock()
+
+	methods, ok := m.grpcMethods[route]
+	if !ok {
+		methods = make(map[string]bool)
+		m.grpcMethods[route] = methods
+	}
+	key := call.Service + "/" + call.Method
+	if !methods[key] {
+		if !call.implemented() || len(methods) >= maxGRPCMethods {
+			return "other", "other"
+		}
+		methods[key] = true
+	}
+	return call.Service, call.Method
+}
+
+// dialer records the time to connect to the onions through the given dialer
+func (m *Metrics) dialer(dialer proxy.ContextDialer) proxy.ContextDialer {
+	if m == nil {
+		return dialer
+	}
+	return &metricsDialer{dialer: dialer, metrics: m}
+}
+
+type metricsDialer struct {
+	dialer  proxy.ContextDialer
+	metrics *Metrics
+}
+
+func (d *metricsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *metricsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	route := withoutOnion(address)
+	if err != nil {
+		d.metrics.dialErrors.WithLabelValues(route).Inc()
+		return nil, err
+	}
+	d.metrics.dialDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	return conn, nil
+}
+
+// trace records the time from getting a connection to the onion, new or reused, to the first byte of the response
+func (m *Metrics) trace(req *http.Request) *http.Request {
+	if m == nil {
+		return req
+	}
+
+	route := withoutOnion(req.URL.Host)
+	var gotConn time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			gotConn = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			if !gotConn.IsZero() {
+				m.upstreamDuration.WithLabelValues(route).Observe(time.Since(gotConn).Seconds())
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// listener counts the connections open on the listener
+func (m *Metrics) listener(lis net.Listener, name string) net.Listener {
+	if m == nil {
+		return lis
+	}
+	return &metricsListener{Listener: lis, connections: m.activeConnections.WithLabelValues(name)}
+}
+
+type metricsListener struct {
+	net.Listener
+	connections prometheus.Gauge
+}
+
+func (l *metricsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.connections.Inc()
+	return &metricsConn{Conn: conn, connections: l.connections}, nil
+}
+
+// metricsConn decrements the gauge once closed, by the server or after being hijacked for h2c
+type metricsConn struct {
+	net.Conn
+	connections prometheus.Gauge
+	once        sync.Once
+}
+
+func (c *metricsConn) Close() error {
+	c.once.Do(c.connections.Dec)
+	return c.Conn.Close()
+}
+
+// countingReader counts the bytes read from the request body, possibly by the goroutine of the transport
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
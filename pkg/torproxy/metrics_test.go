@@ -0,0 +1,147 @@
+package torproxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// scrape returns the metrics in the Prometheus text format
+func scrape(metrics *torproxy.Metrics) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, torproxy.MetricsPath, nil))
+	return rec.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "pong")
+	}))
+	socks.InjectError(secondOnionHost, torproxytest.ReplyHostUnreachable)
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint, "http://"+secondOnionHost+":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	metrics := tp.WithMetrics()
+	// a clearnet upstream added without the opt-in of the registry, refused by the egress policy
+	clearnet, err := url.Parse("http://192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.Redirects = append(tp.Redirects, clearnet)
+
+	address := freeAddress(t)
+	go tp.ServeListeners([]*torproxy.ListenerOptions{{Address: address}})
+	waitListening(t, address)
+	base := "http://" + address
+
+	requests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, route + "/", "", http.StatusOK},
+		{http.MethodPost, route + "/", "ping!", http.StatusOK},
+		{http.MethodGet, route + "/missing", "", http.StatusNotFound},
+		{http.MethodGet, secondRoute + "/", "", http.StatusBadGateway},
+		{http.MethodGet, "/192.0.2.1/", "", http.StatusBadGateway},
+	}
+	for _, r := range requests {
+		req, err := http.NewRequest(r.method, base+r.path, strings.NewReader(r.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != r.status {
+			t.Fatalf("%s %s: got status %d, want %d", r.method, r.path, res.StatusCode, r.status)
+		}
+	}
+
+	// a connection kept open on the listener
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", route, address)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	http.DefaultClient.CloseIdleConnections()
+
+	// a registry update applied, the second onion only, then one refused
+	if _, err := tp.Reload(&torproxy.Settings{Registry: registryOf(t, "http://"+secondOnionHost+":80")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tp.Reload(&torproxy.Settings{}); err == nil {
+		t.Fatal("got a reload without registry applied, want an error")
+	}
+
+	onion, second := `route="`+route[1:]+`"`, `route="`+secondRoute[1:]+`"`
+	connections := `torproxy_active_connections{listener="` + address + `"} 1`
+	want := []string{
+		`torproxy_requests_total{code="200",` + onion + `} 3`,
+		`torproxy_requests_total{code="404",` + onion + `} 1`,
+		`torproxy_requests_total{code="502",` + second + `} 1`,
+		`torproxy_requests_total{code="502",route="192.0.2.1"} 1`,
+		`torproxy_request_duration_seconds_count{` + onion + `} 4`,
+		`torproxy_upstream_duration_seconds_count{` + onion + `} 4`,
+		`torproxy_request_bytes_total{` + onion + `} 5`,
+		`torproxy_response_bytes_total{` + onion + `} 12`,
+		`torproxy_active_streams{` + onion + `} 0`,
+		connections,
+		`torproxy_tor_dial_errors_total{` + second + `} 1`,
+		`torproxy_registry_updates_total{result="success"} 1`,
+		`torproxy_registry_updates_total{result="error"} 1`,
+		`torproxy_routes 1`,
+		`torproxy_tor_backends_healthy 1`,
+		`torproxy_egress_refused_total 1`,
+	}
+
+	// the idle connections of the client are closed by the server asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	scraped := scrape(metrics)
+	for !strings.Contains(scraped, connections+"\n") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		scraped = scrape(metrics)
+	}
+	for _, w := range want {
+		if !strings.Contains(scraped, w+"\n") {
+			t.Errorf("metric %s not found", w)
+		}
+	}
+	if strings.Contains(scraped, `torproxy_tor_dial_duration_seconds_count{`+second+`}`) {
+		t.Error("got the failed dials observed in the dial durations, want them counted as errors only")
+	}
+	if !strings.Contains(scraped, `torproxy_tor_dial_duration_seconds_count{`+onion+`}`) {
+		t.Error("got no dial duration observed for the onion")
+	}
+	if t.Failed() {
+		t.Log(scraped)
+	}
+}
@@ -0,0 +1,48 @@
+package torproxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AllowlistDecisionFunc returns a decision function for on-demand TLS approving the names matching one of the patterns
+// a pattern is either an exact domain or a wildcard like *.example.com matching a single subdomain label
+func AllowlistDecisionFunc(patterns []string) func(name string) error {
+	return func(name string) error {
+		for _, p := range patterns {
+			if matchDomain(p, name) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not allowed to obtain a certificate on demand", name)
+	}
+}
+
+// matchDomain compares the name with the domain pattern, case insensitive
+func matchDomain(pattern, name string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == name
+	}
+
+	i := strings.Index(name, ".")
+	if i <= 0 {
+		return false
+	}
+	return name[i+1:] == pattern[2:]
+}
+
+// decisionFunc returns the on-demand decision function of the options
+// the domains to manage are always allowed, along with the AllowedDomains
+func (o *TLSOptions) decisionFunc() func(name string) error {
+	if o.DecisionFunc != nil {
+		return o.DecisionFunc
+	}
+
+	patterns := make([]string, 0, len(o.Domains)+len(o.AllowedDomains))
+	patterns = append(patterns, o.Domains...)
+	patterns = append(patterns, o.AllowedDomains...)
+	return AllowlistDecisionFunc(patterns)
+}
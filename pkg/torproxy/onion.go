@@ -0,0 +1,223 @@
+package torproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+// OnionServiceOptions defines how the proxy router is published as a v3 onion service
+// If ControlAddress is empty a tor process is started with the tor executable found in the PATH (or ExePath)
+// otherwise the onion service is added to the running tor client via the ADD_ONION control port command
+type OnionServiceOptions struct {
+	ControlAddress  string
+	ControlPassword string
+	ExePath         string
+	DataDir         string
+	// KeyPath is the file persisting the onion service private key, the onion address is stable across restarts
+	KeyPath string
+	// RemotePort is the virtual port of the onion service, 80 if not given
+	RemotePort int
+	// LocalAddress is the address the proxy listens on for onion traffic, 127.0.0.1 with a random port if not given
+	LocalAddress string
+	// TargetAddress is the address tor forwards the onion traffic to, LocalAddress if not given
+	// useful when the tor client runs in another container than the proxy
+	TargetAddress string
+}
+
+// OnionService is the onion service exposing the proxy router
+type OnionService struct {
+	ID       string
+	Listener net.Listener
+
+	conn *control.Conn
+	tor  *tor.Tor
+}
+
+// Hostname returns the onion address of the service
+func (o *OnionService) Hostname() string {
+	return o.ID + ".onion"
+}
+
+// Close removes the onion service from the tor client and closes the local listener
+func (o *OnionService) Close() error {
+	var errs []string
+
+	if err := o.Listener.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if o.tor != nil {
+		if err := o.tor.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	} else {
+		if o.ID != "" {
+			if err := o.conn.DelOnion(o.ID); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if err := o.conn.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("closing onion service: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// WithOnionService publishes the proxy router as a v3 onion service
+// the service is served by Serve alongside the TLS or plaintext listener
+func (tp *TorProxy) WithOnionService(options *OnionServiceOptions) error {
+	if options == nil {
+		return errors.New("onion service options are required")
+	}
+
+	svc, err := newOnionService(options)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Serving tor proxy on onion service %s\n", svc.Hostname())
+	tp.OnionService = svc
+	return nil
+}
+
+func newOnionService(options *OnionServiceOptions) (*OnionService, error) {
+	remotePort := options.RemotePort
+	if remotePort == 0 {
+		remotePort = 80
+	}
+	localAddress := options.LocalAddress
+	if localAddress == "" {
+		localAddress = "127.0.0.1:0"
+	}
+
+	lis, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return nil, err
+	}
+	targetAddress := options.TargetAddress
+	if targetAddress == "" {
+		targetAddress = lis.Addr().String()
+	}
+
+	svc := &OnionService{Listener: lis}
+	if options.ControlAddress == "" {
+		t, err := tor.Start(context.Background(), &tor.StartConf{
+			ExePath:         options.ExePath,
+			DataDir:         options.DataDir,
+			NoAutoSocksPort: true,
+		})
+		if err != nil {
+			lis.Close()
+			return nil, fmt.Errorf("starting tor: %w", err)
+		}
+		if err := t.EnableNetwork(context.Background(), true); err != nil {
+			t.Close()
+			lis.Close()
+			return nil, fmt.Errorf("bootstrapping tor: %w", err)
+		}
+		svc.tor = t
+		svc.conn = t.Control
+	} else {
+		conn, err := dialControlPort(options.ControlAddress, options.ControlPassword)
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		svc.conn = conn
+	}
+
+	key, err := loadOnionKey(options.KeyPath)
+	if err != nil {
+		svc.Close()
+		return nil, err
+	}
+
+	res, err := svc.conn.AddOnion(&control.AddOnionRequest{
+		Key:   key,
+		Ports: []*control.KeyVal{control.NewKeyVal(strconv.Itoa(remotePort), targetAddress)},
+	})
+	if err != nil {
+		svc.Close()
+		return nil, fmt.Errorf("adding onion service: %w", err)
+	}
+	svc.ID = res.ServiceID
+
+	// persist the generated key to keep the same onion address on restart
+	if res.Key != nil && options.KeyPath != "" {
+		if err := saveOnionKey(options.KeyPath, res.Key); err != nil {
+			svc.Close()
+			return nil, err
+		}
+	}
+
+	return svc, nil
+}
+
+// dialControlPort connects and authenticates to the control port of a running tor client
+func dialControlPort(address, password string) (*control.Conn, error) {
+	c, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to tor control port: %w", err)
+	}
+
+	conn := control.NewConn(textproto.NewConn(c))
+	if err := conn.Authenticate(password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("couldn't authenticate to tor control port: %w", err)
+	}
+
+	return conn, nil
+}
+
+// loadOnionKey reads the key stored at the given path, a new v3 key is requested if the file doesn't exist
+func loadOnionKey(path string) (control.Key, error) {
+	if path == "" {
+		return control.GenKey(control.KeyAlgoED25519V3), nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return control.GenKey(control.KeyAlgoED25519V3), nil
+		}
+		return nil, fmt.Errorf("failed to load onion key: %w", err)
+	}
+
+	key, err := control.KeyFromString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid onion key: %w", err)
+	}
+	if key.Type() != control.KeyTypeED25519V3 {
+		return nil, fmt.Errorf("invalid onion key type %s, only %s is supported", key.Type(), control.KeyTypeED25519V3)
+	}
+
+	return key, nil
+}
+
+func saveOnionKey(path string, key control.Key) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to save onion key: %w", err)
+	}
+
+	data := string(key.Type()) + ":" + key.Blob()
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		return fmt.Errorf("failed to save onion key: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,324 @@
+package torproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// BalancingStrategy is an enum-like type that represents how the pool selects the next SOCKS5 backend
+type BalancingStrategy int
+
+const (
+	RoundRobin BalancingStrategy = iota
+	LeastConnections
+)
+
+// ParseBalancingStrategy returns the BalancingStrategy matching the given name
+func ParseBalancingStrategy(name string) (BalancingStrategy, error) {
+	switch name {
+	case "", "round-robin":
+		return RoundRobin, nil
+	case "least-connections":
+		return LeastConnections, nil
+	default:
+		return RoundRobin, fmt.Errorf("unknown balancing strategy %q", name)
+	}
+}
+
+// ErrNoHealthyBackend is returned when every SOCKS5 backend of the pool has been removed from rotation
+var ErrNoHealthyBackend = errors.New("no healthy socks5 backend available")
+
+// handshakeTimeout is the deadline for a SOCKS5 greeting when checking a backend
+const handshakeTimeout = 10 * time.Second
+
+type backend struct {
+	client  *TorClient
+	dialer  proxy.Dialer
+	active  int64
+	healthy int32
+}
+
+func (b *backend) isHealthy() bool {
+	return atomic.LoadInt32(&b.healthy) == 1
+}
+
+func (b *backend) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&b.healthy, v) != v {
+		if healthy {
+			log.Printf("socks5 backend %s is back in rotation", b.client.Address())
+		} else {
+			log.Printf("socks5 backend %s removed from rotation", b.client.Address())
+		}
+	}
+}
+
+// Pool is a proxy.Dialer that spreads connections over several SOCKS5 backends
+// With health checks, a backend failing to answer the SOCKS5 handshake is removed from rotation until a check succeeds again
+// If every backend is out of rotation, all of them are tried rather than failing every dial
+type Pool struct {
+	backends []*backend
+	strategy BalancingStrategy
+	next     uint64
+	// checking is 1 once the health checks run, the backends are never removed from rotation otherwise
+	checking int32
+
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewPool returns a *Pool dialing through the given tor clients with the given strategy
+func NewPool(clients []*TorClient, strategy BalancingStrategy) (*Pool, error) {
+	if len(clients) == 0 {
+		return nil, errors.New("at least one socks5 backend is required")
+	}
+
+	backends := make([]*backend, 0, len(clients))
+	for _, c := range clients {
+		dialer, err := c.Dialer()
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, &backend{client: c, dialer: dialer, healthy: 1})
+	}
+
+	return &Pool{
+		backends: backends,
+		strategy: strategy,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Clients returns the tor clients of the pool
+func (p *Pool) Clients() []*TorClient {
+	clients := make([]*TorClient, 0, len(p.backends))
+	for _, b := range p.backends {
+		clients = append(clients, b.client)
+	}
+	return clients
+}
+
+// Healthy returns the tor clients currently in rotation
+func (p *Pool) Healthy() []*TorClient {
+	clients := make([]*TorClient, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.isHealthy() {
+			clients = append(clients, b.client)
+		}
+	}
+	return clients
+}
+
+// Dial connects to the address through one of the healthy backends
+func (p *Pool) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address through one of the healthy backends
+// if the selected backend fails the SOCKS5 handshake it is removed from rotation and the next one is tried
+func (p *Pool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	tried := make(map[*backend]bool, len(p.backends))
+
+	for {
+		b := p.pick(tried, false)
+		if b == nil && len(p.Healthy()) == 0 {
+			b = p.pick(tried, true)
+		}
+		if b == nil {
+			return nil, ErrNoHealthyBackend
+		}
+		tried[b] = true
+
+		atomic.AddInt64(&b.active, 1)
+		conn, err := dialContext(ctx, b.dialer, network, address)
+		if err != nil {
+			atomic.AddInt64(&b.active, -1)
+			if ctx.Err() != nil || deadlineExceeded(ctx) {
+				return nil, err
+			}
+			// a reply from the socks server means the backend is alive, only the destination failed
+			if !isSOCKSReplyError(err) {
+				// only the health checks can put the backend back in rotation
+				if atomic.LoadInt32(&p.checking) == 1 {
+					b.setHealthy(false)
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		return &trackedConn{Conn: conn, backend: b}, nil
+	}
+}
+
+// pick selects the next healthy backend not yet tried, or any backend not yet tried if unhealthy is true
+func (p *Pool) pick(tried map[*backend]bool, unhealthy bool) *backend {
+	n := len(p.backends)
+
+	switch p.strategy {
+	case LeastConnections:
+		var selected *backend
+		for _, b := range p.backends {
+			if tried[b] || !(unhealthy || b.isHealthy()) {
+				continue
+			}
+			if selected == nil || atomic.LoadInt64(&b.active) < atomic.LoadInt64(&selected.active) {
+				selected = b
+			}
+		}
+		return selected
+	default:
+		start := atomic.AddUint64(&p.next, 1) - 1
+		for i := 0; i < n; i++ {
+			b := p.backends[(start+uint64(i))%uint64(n)]
+			if !tried[b] && (unhealthy || b.isHealthy()) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+// WithHealthCheck periodically performs a SOCKS5 greeting against every backend
+// and puts it in or out of rotation according to the result
+// a period of 0 or less disables the checks, every backend is kept in rotation, including the ones failing at startup
+func (p *Pool) WithHealthCheck(period time.Duration) {
+	if period <= 0 {
+		for _, b := range p.backends {
+			b.setHealthy(true)
+		}
+		return
+	}
+	atomic.StoreInt32(&p.checking, 1)
+
+	ticker := time.NewTicker(period)
+
+	go func() {
+		for {
+			select {
+			case <-p.done:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				for _, b := range p.backends {
+					b.setHealthy(checkHandshake(b.client) == nil)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the health check go-routine
+func (p *Pool) Close() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// checkHandshake opens a TCP connection to the tor client and expects a valid reply to a SOCKS5 greeting
+func checkHandshake(c *TorClient) error {
+	conn, err := net.DialTimeout("tcp", c.Address(), handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+
+	// version 5, one method: no authentication required or username/password
+	method := byte(0x00)
+	if c.Auth() != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("no acceptable authentication methods")
+	}
+	if method == 0x00 {
+		return nil
+	}
+
+	// RFC 1929 username/password sub-negotiation
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return errors.New("invalid username/password")
+	}
+	req := []byte{0x01, byte(len(c.Username))}
+	req = append(req, c.Username...)
+	req = append(req, byte(len(c.Password)))
+	req = append(req, c.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("username/password authentication failed")
+	}
+
+	return nil
+}
+
+// trackedConn decrements the active connections of its backend once closed
+type trackedConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.backend.active, -1)
+	})
+	return c.Conn.Close()
+}
+
+// dialContext uses the context aware dial of the given dialer when available
+func dialContext(ctx context.Context, d proxy.Dialer, network, address string) (net.Conn, error) {
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, address)
+	}
+	return d.Dial(network, address)
+}
+
+// deadlineExceeded returns true once the deadline of the context is reached
+// the dialer times out the handshake on the deadline itself, possibly before the context is canceled
+func deadlineExceeded(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// isSOCKSReplyError returns true if the error comes from a non succeeded SOCKS5 reply
+// x/net/proxy reports those as "unknown error <reply>"
+func isSOCKSReplyError(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Err == nil {
+		return false
+	}
+	return strings.HasPrefix(opErr.Err.Error(), "unknown error ")
+}
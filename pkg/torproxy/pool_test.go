@@ -0,0 +1,256 @@
+package torproxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// namedServer is a SOCKS5 server whose onion answers with the given name
+func namedServer(name string) *torproxytest.Server {
+	socks := torproxytest.NewServer()
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	return socks
+}
+
+// closedServer returns the tor client of a SOCKS5 server no longer listening
+func closedServer() *torproxy.TorClient {
+	socks := torproxytest.NewServer()
+	socks.Close()
+	return socks.TorClient()
+}
+
+// dialOnion dials the onion through the pool and returns the connection along with the name of the backend serving it
+// the connection is kept alive, it is up to the caller to close it
+func dialOnion(t *testing.T, pool *torproxy.Pool) (net.Conn, string) {
+	t.Helper()
+
+	conn, err := pool.Dial("tcp", onionHost+":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", onionHost)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	name, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, string(name)
+}
+
+// backendOf dials the onion through the pool and returns the name of the backend serving it
+func backendOf(t *testing.T, pool *torproxy.Pool) string {
+	t.Helper()
+
+	conn, name := dialOnion(t, pool)
+	conn.Close()
+	return name
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	a, b := namedServer("a"), namedServer("b")
+	defer a.Close()
+	defer b.Close()
+
+	pool, err := torproxy.NewPool([]*torproxy.TorClient{a.TorClient(), b.TorClient()}, torproxy.RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	// the connections kept open do not change the rotation
+	var got string
+	for i := 0; i < 4; i++ {
+		conn, name := dialOnion(t, pool)
+		defer conn.Close()
+		got += name
+	}
+	if got != "abab" {
+		t.Fatalf("got backends %q, want %q", got, "abab")
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	a, b := namedServer("a"), namedServer("b")
+	defer a.Close()
+	defer b.Close()
+
+	pool, err := torproxy.NewPool([]*torproxy.TorClient{a.TorClient(), b.TorClient()}, torproxy.LeastConnections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	first, name := dialOnion(t, pool)
+	if name != "a" {
+		t.Fatalf("got backend %q with no connection open, want the first one", name)
+	}
+	second, name := dialOnion(t, pool)
+	defer second.Close()
+	if name != "b" {
+		t.Fatalf("got backend %q with a connection open on a, want b", name)
+	}
+	if name := backendOf(t, pool); name != "a" {
+		t.Fatalf("got backend %q with a connection open on each backend, want the first one", name)
+	}
+
+	// a closed connection is no longer counted
+	first.Close()
+	third, name := dialOnion(t, pool)
+	defer third.Close()
+	if name != "a" {
+		t.Fatalf("got backend %q once the connection on a is closed, want a", name)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	live := namedServer("live")
+	defer live.Close()
+
+	tests := []struct {
+		name        string
+		healthCheck time.Duration
+		healthy     int
+	}{
+		// the failing backend is removed from rotation until a health check succeeds
+		{"health checks", time.Hour, 1},
+		// without health checks, nothing could put it back in rotation
+		{"no health check", 0, 2},
+	}
+
+	for _, tt := range tests {
+		pool, err := torproxy.NewPool([]*torproxy.TorClient{closedServer(), live.TorClient()}, torproxy.RoundRobin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.WithHealthCheck(tt.healthCheck)
+
+		for i := 0; i < 3; i++ {
+			if name := backendOf(t, pool); name != "live" {
+				t.Errorf("%s: got backend %q, want the live one", tt.name, name)
+			}
+		}
+		if n := len(pool.Healthy()); n != tt.healthy {
+			t.Errorf("%s: got %d healthy backends, want %d", tt.name, n, tt.healthy)
+		}
+		pool.Close()
+	}
+}
+
+func TestPoolAllBackendsDown(t *testing.T) {
+	pool, err := torproxy.NewPool([]*torproxy.TorClient{closedServer(), closedServer()}, torproxy.RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.WithHealthCheck(time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if _, err := pool.Dial("tcp", onionHost+":80"); err == nil {
+			t.Fatal("got a connection with every backend down, want an error")
+		}
+	}
+	if n := len(pool.Healthy()); n != 0 {
+		t.Fatalf("got %d healthy backends, want 0", n)
+	}
+}
+
+// switchable forwards the connections to a SOCKS5 server while up, and closes them otherwise
+type switchable struct {
+	listener net.Listener
+	target   string
+	up       int32
+}
+
+func newSwitchable(target string) *switchable {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s := &switchable{listener: lis, target: target}
+	go s.serve()
+	return s
+}
+
+func (s *switchable) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&s.up) == 0 {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.Dial("tcp", s.target)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func (s *switchable) torClient() *torproxy.TorClient {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return &torproxy.TorClient{Host: addr.IP.String(), Port: addr.Port}
+}
+
+func waitHealthy(t *testing.T, pool *torproxy.Pool, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pool.Healthy()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d healthy backends, want %d", len(pool.Healthy()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolHealthCheckRecovery(t *testing.T) {
+	a, b := namedServer("a"), namedServer("b")
+	defer a.Close()
+	defer b.Close()
+	flaky := newSwitchable(b.Addr())
+	defer flaky.listener.Close()
+
+	pool, err := torproxy.NewPool([]*torproxy.TorClient{a.TorClient(), flaky.torClient()}, torproxy.RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	pool.WithHealthCheck(10 * time.Millisecond)
+
+	waitHealthy(t, pool, 1)
+	if got := backendOf(t, pool) + backendOf(t, pool); got != "aa" {
+		t.Fatalf("got backends %q while b is down, want only a", got)
+	}
+
+	atomic.StoreInt32(&flaky.up, 1)
+	waitHealthy(t, pool, 2)
+	if got := backendOf(t, pool) + backendOf(t, pool); got != "ab" && got != "ba" {
+		t.Fatalf("got backends %q once b is back, want both", got)
+	}
+}
@@ -0,0 +1,72 @@
+package torproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// ProxyProtocolOptions enables the PROXY protocol v1 and v2 on a listener, for deployments behind L4 load balancers
+// the client address given in the header replaces the address of the balancer throughout the proxy
+type ProxyProtocolOptions struct {
+	// TrustedCIDRs are the ranges allowed to send a PROXY header, the connections from other sources sending one are refused
+	// the peers of unix socket listeners are never trusted, as any local process could spoof the client address
+	TrustedCIDRs []*net.IPNet
+	// ReadHeaderTimeout is how long to wait for the header, 200ms if zero
+	ReadHeaderTimeout time.Duration
+}
+
+// ParseCIDRs parses a list of CIDRs, a single IP is accepted as a /32 or /128 range
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", v, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// wrap returns the listener reading the PROXY header of the connections from the trusted sources
+func (o *ProxyProtocolOptions) wrap(lis net.Listener) net.Listener {
+	return &proxyproto.Listener{
+		Listener:          lis,
+		Policy:            o.policy,
+		ReadHeaderTimeout: o.ReadHeaderTimeout,
+	}
+}
+
+// policy never fails, as an error from Accept would stop serving the listener
+func (o *ProxyProtocolOptions) policy(upstream net.Addr) (proxyproto.Policy, error) {
+	if addr, ok := upstream.(*net.TCPAddr); ok && o.isTrusted(addr.IP) {
+		return proxyproto.USE, nil
+	}
+	return proxyproto.REJECT, nil
+}
+
+func (o *ProxyProtocolOptions) isTrusted(ip net.IP) bool {
+	for _, cidr := range o.TrustedCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package torproxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// proxyProtocolListener serves the test onion on a listener reading the PROXY headers sent from the trusted CIDRs
+// it returns the address, the access log lines and the number of requests received by the onion
+func proxyProtocolListener(t *testing.T, trusted ...string) (string, lineWriter, *int64) {
+	t.Helper()
+
+	cidrs, err := torproxy.ParseCIDRs(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int64
+	socks := torproxytest.NewServer()
+	t.Cleanup(socks.Close)
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+	}))
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tp.Close() })
+	lines := make(lineWriter, 1)
+	tp.AccessLog = log.New(lines, "", 0)
+
+	address := freeAddress(t)
+	go tp.ServeListeners([]*torproxy.ListenerOptions{{
+		Address:       address,
+		ProxyProtocol: &torproxy.ProxyProtocolOptions{TrustedCIDRs: cidrs},
+	}})
+	waitListening(t, address)
+	return address, lines, &requests
+}
+
+// proxyProtocolGet sends a request preceded by the given PROXY header, if any, and returns the response status
+func proxyProtocolGet(t *testing.T, address, header string) (int, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "%sGET %s/ HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", header, route, address)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	const header = "PROXY TCP4 198.51.100.9 127.0.0.1 50000 80\r\n"
+
+	tests := []struct {
+		name    string
+		trusted []string
+		header  string
+		// client is the address in the access log, the header is expected to be refused if empty
+		client string
+	}{
+		{"trusted source", []string{"127.0.0.0/8"}, header, "198.51.100.9:50000"},
+		{"trusted source without header", []string{"127.0.0.1"}, "", "127.0.0.1:"},
+		{"untrusted source", []string{"10.0.0.0/8"}, header, ""},
+		{"untrusted source without header", []string{"10.0.0.0/8"}, "", "127.0.0.1:"},
+		{"no trusted source", nil, header, ""},
+	}
+
+	for _, tt := range tests {
+		address, lines, requests := proxyProtocolListener(t, tt.trusted...)
+		status, err := proxyProtocolGet(t, address, tt.header)
+		if tt.client == "" {
+			// the server answers the read error with a bad request, if anything
+			if err == nil && status != http.StatusBadRequest {
+				t.Errorf("%s: got status %d, want the header refused", tt.name, status)
+			}
+			if n := atomic.LoadInt64(requests); n != 0 {
+				t.Errorf("%s: got %d requests proxied to the onion, want 0", tt.name, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if status != http.StatusOK {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, http.StatusOK)
+		}
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, tt.client) {
+				t.Errorf("%s: got access log %q, want the client %s", tt.name, line, tt.client)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no access log line for the request", tt.name)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	cidrs, err := torproxy.ParseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"} {
+		if got := cidrs[i].String(); got != want {
+			t.Errorf("got CIDR %s, want %s", got, want)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := torproxy.ParseCIDRs([]string{invalid}); err == nil {
+			t.Errorf("got %q parsed, want an error", invalid)
+		}
+	}
+}
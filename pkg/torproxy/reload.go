@@ -0,0 +1,353 @@
+package torproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tdex-network/tor-proxy/pkg/registry"
+)
+
+// Settings are the options of a TorProxy that can be changed while serving, see Reload
+// listeners, TLS, tor clients and the onion service are not part of it, changing them requires a restart
+type Settings struct {
+	// Registry lists the onions to proxy, it is fetched again by Reload
+	Registry       registry.Registry
+	HeaderPolicy   *HeaderPolicy
+	CORSPolicy     *CORSPolicy
+	HostRouting    *HostRoutingOptions
+	AllowedClients []string
+	// Routes holds the per-route options keyed by onion host, as TorProxy.Routes
+	Routes map[string]*RouteOptions
+}
+
+// routingTable is the result of parsing a registry
+type routingTable struct {
+	redirects []*url.URL
+	// clearnet lists the clearnet hosts opted-in by the registry
+	clearnet []string
+	aliases  map[string]string
+}
+
+// parseRegistry returns the routing table of the registry JSON, failing on the first invalid endpoint URL
+func parseRegistry(registryJSON []byte) (*routingTable, error) {
+	entries, err := parseRegistryJSONtoRedirects(registryJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &routingTable{aliases: make(map[string]string)}
+	for _, to := range entries {
+		// we parse the destination upstram which should be on *.onion address
+		origin, err := url.Parse(to.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse address : %v", err)
+		}
+
+		if to.Clearnet {
+			table.clearnet = append(table.clearnet, strings.ToLower(origin.Hostname()))
+		}
+		if to.Alias != "" {
+			table.aliases[strings.ToLower(to.Alias)] = withoutOnion(origin.Host)
+		}
+		if !includesRedirect(table.redirects, origin) {
+			table.redirects = append(table.redirects, origin)
+		}
+	}
+	return table, nil
+}
+
+// Reload validates the given settings and applies them without closing the listeners nor the tor circuits
+// the registry is fetched first and nothing changes if it or any of the settings is invalid
+// the requests in flight complete with the previous settings, it returns the list of changes
+func (tp *TorProxy) Reload(settings *Settings) ([]string, error) {
+	changes, err := tp.reload(settings)
+	tp.Metrics.registryUpdate(err)
+	return changes, err
+}
+
+func (tp *TorProxy) reload(settings *Settings) ([]string, error) {
+	if settings.Registry == nil {
+		return nil, errors.New("a registry is required")
+	}
+	registryJSON, err := settings.Registry.GetJSON()
+	if err != nil {
+		return nil, fmt.Errorf("fetching registry: %w", err)
+	}
+	table, err := parseRegistry(registryJSON)
+	if err != nil {
+		return nil, fmt.Errorf("parsing registry: %w", err)
+	}
+	if err := settings.validate(table); err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]*RouteOptions, len(settings.Routes))
+	for host, options := range settings.Routes {
+		routes[strings.ToLower(host)] = options
+	}
+
+	// the auto-updater observes the registry it has been started with, it is stopped before taking the lock
+	// so that a fetch of the previous registry in progress is applied before the reload, not after it
+	tp.configMu.Lock()
+	registryChanged := !sameRegistry(tp.Registry, settings.Registry)
+	tp.configMu.Unlock()
+	restartAutoUpdater := registryChanged && tp.closeAutoUpdaterFunc != nil
+	if restartAutoUpdater {
+		tp.closeAutoUpdaterFunc()
+	}
+
+	changes, err := tp.apply(settings, routes, table, registryChanged)
+
+	if restartAutoUpdater {
+		tp.startAutoUpdater()
+	}
+
+	return changes, err
+}
+
+// apply swaps the settings and rebuilds the router, it returns the list of changes
+// the previous settings and router are kept if the router cannot be built
+func (tp *TorProxy) apply(settings *Settings, routes map[string]*RouteOptions, table *routingTable, registryChanged bool) ([]string, error) {
+	tp.configMu.Lock()
+	defer tp.configMu.Unlock()
+
+	changes := tp.diff(settings, routes, table)
+
+	previous := tp.swap(&appliedSettings{
+		headerPolicy:   settings.HeaderPolicy,
+		corsPolicy:     settings.CORSPolicy,
+		hostRouting:    settings.HostRouting,
+		allowedClients: settings.AllowedClients,
+		routes:         routes,
+		aliases:        table.aliases,
+		redirects:      table.redirects,
+	})
+	if err := tp.buildRouter(); err != nil {
+		tp.swap(previous)
+		return nil, err
+	}
+
+	if registryChanged {
+		tp.Registry = settings.Registry
+	}
+
+	// only the clearnet hosts opted-in by the previous registry are revoked
+	egress := tp.egressPolicy()
+	for _, host := range tp.registryClearnet {
+		if !containsString(table.clearnet, host) {
+			egress.revokeClearnet(host)
+		}
+	}
+	for _, host := range table.clearnet {
+		egress.AllowClearnet(host)
+	}
+	tp.registryClearnet = table.clearnet
+
+	return changes, nil
+}
+
+// appliedSettings are the fields of TorProxy the router is built from
+type appliedSettings struct {
+	headerPolicy   *HeaderPolicy
+	corsPolicy     *CORSPolicy
+	hostRouting    *HostRoutingOptions
+	allowedClients []string
+	routes         map[string]*RouteOptions
+	aliases        map[string]string
+	redirects      []*url.URL
+}
+
+// swap sets the given settings, returning the previous ones
+func (tp *TorProxy) swap(s *appliedSettings) *appliedSettings {
+	previous := &appliedSettings{
+		headerPolicy:   tp.HeaderPolicy,
+		corsPolicy:     tp.CORSPolicy,
+		hostRouting:    tp.HostRouting,
+		allowedClients: tp.AllowedClients,
+		routes:         tp.Routes,
+		aliases:        tp.registryAliases,
+		redirects:      tp.Redirects,
+	}
+	tp.HeaderPolicy = s.headerPolicy
+	tp.CORSPolicy = s.corsPolicy
+	tp.HostRouting = s.hostRouting
+	tp.AllowedClients = s.allowedClients
+	tp.Routes = s.routes
+	tp.registryAliases = s.aliases
+	tp.Redirects = s.redirects
+	return previous
+}
+
+// sameRegistry returns true if both registries have the same type and source, ie. URL or JSON content
+func sameRegistry(a, b registry.Registry) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// validate checks that every onion has its own route and that the aliases and the per-route options refer to onions of the registry
+func (s *Settings) validate(table *routingTable) error {
+	if err := checkRoutes(table.redirects); err != nil {
+		return fmt.Errorf("registry: %w", err)
+	}
+
+	known := make(map[string]bool, len(table.redirects))
+	for _, to := range table.redirects {
+		known[withoutOnion(to.Host)] = true
+	}
+
+	if s.HostRouting != nil {
+		if len(s.HostRouting.BaseDomains) == 0 {
+			return errors.New("host routing requires a base domain")
+		}
+		for label, onion := range s.HostRouting.Aliases {
+			if !known[withoutOnion(onion)] {
+				return fmt.Errorf("alias %s: %s is not in the registry", label, onion)
+			}
+		}
+	}
+
+	for host := range s.Routes {
+		if !known[withoutOnion(host)] {
+			return fmt.Errorf("route options: %s is not in the registry", host)
+		}
+	}
+	return nil
+}
+
+// diff lists the differences between the current settings of the proxy and the given ones
+func (tp *TorProxy) diff(settings *Settings, routes map[string]*RouteOptions, table *routingTable) []string {
+	var changes []string
+
+	current := make(map[string]bool, len(tp.Redirects))
+	for _, to := range tp.Redirects {
+		current[to.Host] = true
+	}
+	next := make(map[string]bool, len(table.redirects))
+	for _, to := range table.redirects {
+		next[to.Host] = true
+		if !current[to.Host] {
+			changes = append(changes, fmt.Sprintf("route added: %s", to.Host))
+		}
+	}
+	for _, to := range tp.Redirects {
+		if !next[to.Host] {
+			changes = append(changes, fmt.Sprintf("route removed: %s", to.Host))
+		}
+	}
+
+	if !reflect.DeepEqual(tp.registryAliases, table.aliases) && len(tp.registryAliases)+len(table.aliases) > 0 {
+		changes = append(changes, fmt.Sprintf("registry aliases: %s -> %s", formatMap(tp.registryAliases), formatMap(table.aliases)))
+	}
+	if !reflect.DeepEqual(tp.HeaderPolicy, settings.HeaderPolicy) {
+		changes = append(changes, "header policy changed")
+	}
+	if !reflect.DeepEqual(tp.CORSPolicy, settings.CORSPolicy) {
+		changes = append(changes, "CORS policy changed")
+	}
+	if !reflect.DeepEqual(tp.HostRouting, settings.HostRouting) {
+		changes = append(changes, "host routing changed")
+	}
+	if !equalStrings(tp.AllowedClients, settings.AllowedClients) {
+		changes = append(changes, fmt.Sprintf("allowed clients: %v -> %v", tp.AllowedClients, settings.AllowedClients))
+	}
+
+	hosts := make(map[string]bool, len(tp.Routes)+len(routes))
+	for host := range tp.Routes {
+		hosts[host] = true
+	}
+	for host := range routes {
+		hosts[host] = true
+	}
+	for _, host := range sortedKeys(hosts) {
+		if !reflect.DeepEqual(tp.Routes[host], routes[host]) {
+			changes = append(changes, fmt.Sprintf("options of route %s changed", host))
+		}
+	}
+
+	return changes
+}
+
+// buildRouter builds the routing table of the proxy, served from then on by Handler
+// the current router is kept if an error is returned
+func (tp *TorProxy) buildRouter() error {
+	mux, hosts, err := reverseProxy(tp.Redirects, tp.dialer(), tp.routeOptions, tp.Metrics)
+	if err != nil {
+		return err
+	}
+
+	var handler http.Handler = mux
+	var router *hostRouter
+	if tp.HostRouting != nil {
+		router = newHostRouter(tp.HostRouting, tp.aliases(), hosts, mux)
+		handler = router
+	}
+	tp.hostRouter.Store(router)
+	tp.router.Store(routerHolder{handler})
+	return nil
+}
+
+// checkRoutes returns an error if two redirects are served on the same route /<just_onion_host_without_dot_onion>/
+// eg. the same onion on two ports
+func checkRoutes(redirects []*url.URL) error {
+	routes := make(map[string]string, len(redirects))
+	for _, to := range redirects {
+		route := withoutOnion(to.Host)
+		if other, ok := routes[route]; ok {
+			return fmt.Errorf("%s and %s are served on the same route /%s/", other, to.Host, route)
+		}
+		routes[route] = to.Host
+	}
+	return nil
+}
+
+// routerHolder keeps the type stored in TorProxy.router the same, as required by atomic.Value
+type routerHolder struct {
+	http.Handler
+}
+
+func includesRedirect(redirects []*url.URL, redirect *url.URL) bool {
+	for _, proxyRedirect := range redirects {
+		if proxyRedirect.Host == redirect.Host {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatMap(m map[string]string) string {
+	keys := make(map[string]bool, len(m))
+	for k := range m {
+		keys[k] = true
+	}
+	pairs := make([]string, 0, len(m))
+	for _, k := range sortedKeys(keys) {
+		pairs = append(pairs, k+"="+m[k])
+	}
+	return "[" + strings.Join(pairs, " ") + "]"
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
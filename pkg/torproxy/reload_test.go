@@ -0,0 +1,224 @@
+package torproxy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/registry"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// secondRoute is the path prefix of secondOnionHost on the proxy
+const secondRoute = "/torproxytestbbbb"
+
+// mutableRegistry is a registry whose endpoints can be changed while observed
+type mutableRegistry struct {
+	mu   sync.Mutex
+	json string
+}
+
+func (r *mutableRegistry) RegistryType() registry.RegistryType {
+	return registry.RemoteRegistryType
+}
+
+func (r *mutableRegistry) GetJSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return []byte(r.json), nil
+}
+
+func (r *mutableRegistry) set(endpoints ...string) {
+	entries := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		entries = append(entries, fmt.Sprintf(`{"endpoint": %q}`, e))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.json = "[" + strings.Join(entries, ", ") + "]"
+}
+
+// reloadProxy serves the test onions, the first one on /slow once released, behind a proxy of the first onion
+func reloadProxy(t *testing.T, release <-chan struct{}) (*torproxy.TorProxy, string, <-chan struct{}, func()) {
+	t.Helper()
+
+	started := make(chan struct{}, 1)
+	socks := torproxytest.NewServer()
+	socks.AddOnion(onionHost, slowOnion(started, release))
+	socks.AddOnion(secondOnionHost, slowOnion(started, release))
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		socks.Close()
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(tp.Handler())
+
+	return tp, srv.URL, started, func() {
+		srv.Close()
+		tp.Close()
+		socks.Close()
+	}
+}
+
+func registryOf(t *testing.T, endpoints ...string) registry.Registry {
+	t.Helper()
+
+	reg, err := torproxytest.RegistryFromEndpoints(endpoints...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestReload(t *testing.T) {
+	tp, url, _, closeFunc := reloadProxy(t, nil)
+	defer closeFunc()
+
+	changes, err := tp.Reload(&torproxy.Settings{
+		Registry:   registryOf(t, endpoint, "http://"+secondOnionHost+":80"),
+		CORSPolicy: &torproxy.CORSPolicy{AllowedOrigins: []string{"https://example.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"route added: " + secondOnionHost + ":80", "CORS policy changed"}
+	if strings.Join(changes, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got changes %q, want %q", changes, want)
+	}
+	for _, path := range []string{route + "/", secondRoute + "/"} {
+		if status := getStatus(t, url+path); status != http.StatusOK {
+			t.Errorf("%s: got status %d after the reload, want %d", path, status, http.StatusOK)
+		}
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	tp, url, _, closeFunc := reloadProxy(t, nil)
+	defer closeFunc()
+
+	tests := []struct {
+		name     string
+		settings *torproxy.Settings
+		err      string
+	}{
+		{
+			name:     "no registry",
+			settings: &torproxy.Settings{},
+			err:      "a registry is required",
+		},
+		{
+			name: "route options of an onion not in the registry",
+			settings: &torproxy.Settings{
+				Registry: registryOf(t, "http://"+secondOnionHost+":80"),
+				Routes:   map[string]*torproxy.RouteOptions{onionHost: {}},
+			},
+			err: "not in the registry",
+		},
+		{
+			name: "alias of an onion not in the registry",
+			settings: &torproxy.Settings{
+				Registry: registryOf(t, "http://"+secondOnionHost+":80"),
+				HostRouting: &torproxy.HostRoutingOptions{
+					BaseDomains: []string{baseDomain},
+					Aliases:     map[string]string{"provider": onionHost},
+				},
+			},
+			err: "not in the registry",
+		},
+		{
+			name: "same onion on two ports",
+			settings: &torproxy.Settings{
+				Registry: registryOf(t, endpoint, "http://"+onionHost+":8080"),
+			},
+			err: "served on the same route",
+		},
+	}
+
+	for _, tt := range tests {
+		if _, err := tp.Reload(tt.settings); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+
+		// the previous routes are kept
+		if status := getStatus(t, url+route+"/"); status != http.StatusOK {
+			t.Errorf("%s: got status %d for the current onion, want %d", tt.name, status, http.StatusOK)
+		}
+		if status := getStatus(t, url+secondRoute+"/"); status != http.StatusNotFound {
+			t.Errorf("%s: got status %d for the onion of the rejected registry, want %d", tt.name, status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestReloadInFlight(t *testing.T) {
+	release := make(chan struct{})
+	tp, url, started, closeFunc := reloadProxy(t, release)
+	defer closeFunc()
+
+	slow := getAsync(url + route + "/slow")
+	<-started
+
+	changes, err := tp.Reload(&torproxy.Settings{Registry: registryOf(t, "http://"+secondOnionHost+":80")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("got changes %q, want the route of each onion added and removed", changes)
+	}
+
+	if status := getStatus(t, url+route+"/"); status != http.StatusNotFound {
+		t.Errorf("got status %d for the removed onion, want %d", status, http.StatusNotFound)
+	}
+	close(release)
+	if r := <-slow; r.err != nil || r.status != http.StatusOK || r.body != "done" {
+		t.Fatalf("got %d %q, %v for the request in flight during the reload, want it completed", r.status, r.body, r.err)
+	}
+}
+
+func TestAutoUpdater(t *testing.T) {
+	tp, url, _, closeFunc := reloadProxy(t, nil)
+	defer closeFunc()
+
+	reg := &mutableRegistry{}
+	reg.set(endpoint)
+	if err := tp.WithRegistry(reg); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 10)
+	tp.WithAutoUpdater(10*time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	// an update listing the same onion on another port is refused, the onion stays served
+	reg.set(endpoint, "http://"+onionHost+":8080")
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "served on the same route") {
+			t.Fatalf("got update error %v, want the duplicate onion refused", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the update with the same onion on two ports has not been refused")
+	}
+	if status := getStatus(t, url+route+"/"); status != http.StatusOK {
+		t.Fatalf("got status %d after a refused update, want %d", status, http.StatusOK)
+	}
+
+	reg.set(endpoint, "http://"+secondOnionHost+":80")
+	deadline := time.Now().Add(5 * time.Second)
+	for getStatus(t, url+secondRoute+"/") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("the onion added to the registry is not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
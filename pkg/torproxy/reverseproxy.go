@@ -1,6 +1,8 @@
 package torproxy
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -9,27 +11,106 @@ import (
 	"time"
 
 	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/proxy"
 )
 
-func generateReverseProxy(origin *url.URL, dialer proxy.Dialer) *httputil.ReverseProxy {
+func generateReverseProxy(origin *url.URL, dialer proxy.ContextDialer, policy *HeaderPolicy, metrics *Metrics) *httputil.ReverseProxy {
 
 	// We prepare here the request to set
 	director := func(req *http.Request) {
-		req.Header.Add("X-Forwarded-Host", req.Host)
+		if policy.ForwardHost {
+			req.Header.Add("X-Forwarded-Host", req.Host)
+		}
+		if !policy.ForwardClientIP {
+			// a nil value prevents httputil.ReverseProxy from appending the client IP
+			req.Header["X-Forwarded-For"] = nil
+		}
 		req.Header.Add("X-Origin-Host", origin.Host)
+		// https is only used by the clearnet upstreams, the onions are end-to-end encrypted by tor
 		req.URL.Scheme = "http"
+		if origin.Scheme == "https" {
+			req.URL.Scheme = "https"
+		}
 		req.URL.Host = origin.Host
 		req.Host = origin.Host
 	}
-	transport := &http.Transport{
-		Dial:                dialer.Dial,
-		TLSHandshakeTimeout: 10 * time.Second,
+	transport := &upstreamTransport{
+		metrics: metrics,
+		// the https upstreams are dialed with DialContext too, then the TLS handshake is done by the transport
+		http1: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			// the dial is canceled with the request, eg. when the client goes away or the proxy shuts down
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil || origin.Scheme != "https" {
+					return conn, err
+				}
+				// TLS over the dialer, the default one would dial the clearnet upstream directly
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			// a circuit gone silent is pinged, then closed, failing its streams instead of hanging them
+			ReadIdleTimeout: h2cReadIdleTimeout,
+			PingTimeout:     h2cPingTimeout,
+		},
+	}
+	// the CORS headers are set by the proxy policy before proxying
+	modifyResponse := func(res *http.Response) error {
+		removeCorsHeaders(res.Header)
+		// the alternative services of the onion are not reachable by the clients, the proxy advertises its own
+		res.Header.Del("Alt-Svc")
+		return nil
+	}
+	revproxy := &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      transport,
+		ModifyResponse: modifyResponse,
+		// flush every write to preserve the gRPC streams
+		FlushInterval: -1,
 	}
-	revproxy := &httputil.ReverseProxy{Director: director, Transport: transport}
 	return revproxy
 }
 
+// h2cReadIdleTimeout and h2cPingTimeout detect the dead circuits of the upstream HTTP/2 connections
+// they are longer than the usual ones as the round-trip through tor is of several seconds
+const (
+	h2cReadIdleTimeout = 60 * time.Second
+	h2cPingTimeout     = 20 * time.Second
+)
+
+// upstreamTransport proxies gRPC requests with HTTP/2 cleartext, as the upstream gRPC servers require,
+// and any other request with HTTP/1.1
+type upstreamTransport struct {
+	http1   *http.Transport
+	h2c     *http2.Transport
+	metrics *Metrics
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = t.metrics.trace(req)
+	if isGRPC(req) {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.http1.RoundTrip(req)
+}
+
+// isGRPC returns true for native gRPC requests, received over HTTP/2 or HTTP/3, gRPC-Web ones are served over HTTP/1.1
+func isGRPC(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return req.ProtoMajor >= 2 &&
+		strings.HasPrefix(contentType, "application/grpc") &&
+		!strings.HasPrefix(contentType, "application/grpc-web")
+}
+
 // Copyright 2015 Matthew Holt and The Caddy Authors
 // Taken from https://github.com/caddyserver/caddy/blob/master/modules/caddyhttp/reverseproxy/reverseproxy.go
 
@@ -57,7 +138,8 @@ var hopHeaders = []string{
 // be done just once (before proxying) regardless of proxy retries.
 // This assumes that no mutations of the request are performed
 // by h during or after proxying.
-func prepareRequest(req *http.Request) error {
+// The client-identifying headers are stripped according to the given policy.
+func prepareRequest(req *http.Request, policy *HeaderPolicy) error {
 	// most of this is borrowed from the Go std lib reverse proxy
 
 	if req.ContentLength == 0 {
@@ -102,15 +184,9 @@ func prepareRequest(req *http.Request) error {
 		req.Header.Set("Upgrade", reqUpType)
 	}
 
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		// If we aren't the first proxy retain prior
-		// X-Forwarded-For information as a comma+space
-		// separated list and fold multiple headers into one.
-		if prior, ok := req.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
-		}
-		req.Header.Set("X-Forwarded-For", clientIP)
-	}
+	// The client IP is appended to X-Forwarded-For by httputil.ReverseProxy
+	// if the policy allows it, prior information is retained.
+	policy.apply(req)
 
 	if req.Header.Get("X-Forwarded-Proto") == "" {
 		// set X-Forwarded-Proto; many backend apps expect this too
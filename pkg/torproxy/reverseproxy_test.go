@@ -0,0 +1,56 @@
+package torproxy_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+func TestUpstreamProtocol(t *testing.T) {
+	protos := make(chan string, 1)
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto
+	}))
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Pool.Close()
+	handler := tp.Handler()
+
+	tests := []struct {
+		proto       string
+		major       int
+		contentType string
+		want        string
+	}{
+		// the gRPC calls are proxied with HTTP/2 cleartext whatever the protocol of the client
+		{"HTTP/2.0", 2, "application/grpc", "HTTP/2.0"},
+		{"HTTP/3.0", 3, "application/grpc+proto", "HTTP/2.0"},
+		{"HTTP/3.0", 3, "application/grpc-web+proto", "HTTP/1.1"},
+		{"HTTP/3.0", 3, "application/json", "HTTP/1.1"},
+		{"HTTP/1.1", 1, "application/grpc", "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, route+"/"+grpcService+"/"+grpcMethod, bytes.NewReader(grpcFrame(0x00, "request")))
+		req.Proto, req.ProtoMajor, req.ProtoMinor = tt.proto, tt.major, 0
+		req.Header.Set("Content-Type", tt.contentType)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s %s: got status %d, want %d", tt.proto, tt.contentType, rec.Code, http.StatusOK)
+			continue
+		}
+		if got := <-protos; got != tt.want {
+			t.Errorf("%s %s: got %s to the onion, want %s", tt.proto, tt.contentType, got, tt.want)
+		}
+	}
+}
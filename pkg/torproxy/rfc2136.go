@@ -0,0 +1,104 @@
+package torproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+// RFC2136Provider solves DNS-01 challenges by sending RFC 2136 dynamic updates, signed with TSIG, to an authoritative server
+// it works with BIND, Knot, PowerDNS and most self-hosted DNS servers
+type RFC2136Provider struct {
+	// Server is the host:port of the DNS server accepting the updates
+	Server string
+	// TSIGKeyName, TSIGSecret (base64) and TSIGAlgorithm (hmac-sha256 if empty) sign the updates, unsigned if TSIGKeyName is empty
+	TSIGKeyName   string
+	TSIGSecret    string
+	TSIGAlgorithm string
+	// Timeout of each update, 10 seconds if zero
+	Timeout time.Duration
+}
+
+// AppendRecords adds the records to the zone
+func (p *RFC2136Provider) AppendRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := p.rrs(zone, records)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(zone))
+	msg.Insert(rrs)
+	if err := p.exchange(ctx, msg); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DeleteRecords removes the records from the zone
+func (p *RFC2136Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := p.rrs(zone, records)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(zone))
+	msg.Remove(rrs)
+	if err := p.exchange(ctx, msg); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (p *RFC2136Provider) rrs(zone string, records []libdns.Record) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, r := range records {
+		name := libdns.AbsoluteName(r.Name, dns.Fqdn(zone))
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(name), int(r.TTL.Seconds()), r.Type, quoteValue(r)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record %s: %w", r.Type, name, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+func (p *RFC2136Provider) exchange(ctx context.Context, msg *dns.Msg) error {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client := &dns.Client{Net: "tcp", Timeout: timeout}
+
+	if p.TSIGKeyName != "" {
+		keyName := dns.Fqdn(p.TSIGKeyName)
+		algorithm := dns.HmacSHA256
+		if p.TSIGAlgorithm != "" {
+			algorithm = dns.Fqdn(strings.ToLower(p.TSIGAlgorithm))
+		}
+		client.TsigSecret = map[string]string{keyName: p.TSIGSecret}
+		msg.SetTsig(keyName, algorithm, 300, time.Now().Unix())
+	}
+
+	reply, _, err := client.ExchangeContext(ctx, msg, p.Server)
+	if err != nil {
+		return fmt.Errorf("dns update to %s: %w", p.Server, err)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dns update to %s: %s", p.Server, dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// quoteValue quotes the value of TXT records, as expected by the zone file syntax
+func quoteValue(r libdns.Record) string {
+	if strings.EqualFold(r.Type, "TXT") && !strings.HasPrefix(r.Value, `"`) {
+		return fmt.Sprintf("%q", r.Value)
+	}
+	return r.Value
+}
@@ -0,0 +1,53 @@
+package torproxy
+
+import (
+	"net/url"
+	"strings"
+)
+
+// RouteOptions holds the settings of a single route, overriding the TorProxy-wide ones when set
+type RouteOptions struct {
+	Headers *HeaderPolicy
+	CORS    *CORSPolicy
+	// AllowedClients lists the subjects of the verified client certificates allowed on the route
+	AllowedClients []string
+}
+
+// WithRouteOptions sets the options of the route to the given onion host, with or without port
+// it must be called before Serve to take effect, use Reload to change the routes while serving
+func (tp *TorProxy) WithRouteOptions(host string, options *RouteOptions) {
+	if tp.Routes == nil {
+		tp.Routes = make(map[string]*RouteOptions)
+	}
+	tp.Routes[strings.ToLower(host)] = options
+}
+
+// routeOptions returns the options of the route to the given redirect, filled with the TorProxy-wide defaults
+func (tp *TorProxy) routeOptions(to *url.URL) *RouteOptions {
+	options := &RouteOptions{}
+	if o, ok := tp.Routes[strings.ToLower(to.Host)]; ok && o != nil {
+		*options = *o
+	} else if o, ok := tp.Routes[strings.ToLower(to.Hostname())]; ok && o != nil {
+		*options = *o
+	}
+
+	if options.Headers == nil {
+		options.Headers = tp.HeaderPolicy
+	}
+	if options.Headers == nil {
+		options.Headers = PrivacyHeaderPolicy()
+	}
+
+	if options.CORS == nil {
+		options.CORS = tp.CORSPolicy
+	}
+	if options.CORS == nil {
+		options.CORS = DefaultCORSPolicy()
+	}
+
+	if options.AllowedClients == nil {
+		options.AllowedClients = tp.AllowedClients
+	}
+
+	return options
+}
@@ -0,0 +1,123 @@
+package torproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadinessPath answers 200 on the admin listener while the proxy accepts new requests and 503 once it is shutting down
+// it is meant for the health checks of the load balancers, so they stop routing to the proxy before it stops listening
+// it is not served on the other listeners, where it may be a path of an onion routed by host
+const ReadinessPath = "/ready"
+
+// Ready returns false once Shutdown has been called
+func (tp *TorProxy) Ready() bool {
+	return atomic.LoadInt32(&tp.draining) == 0
+}
+
+// Shutdown gracefully shuts down the proxy
+// the proxy is flagged as not ready first and keeps serving for ShutdownDelay, then the listeners are closed
+// and the in-flight requests, including the gRPC streams, are waited for until the context is done
+// everything is closed when it returns, the error of the context is returned if the requests did not complete in time
+func (tp *TorProxy) Shutdown(ctx context.Context) error {
+	tp.serversMu.Lock()
+	atomic.StoreInt32(&tp.draining, 1)
+	servers := tp.servers
+	tp.serversMu.Unlock()
+
+	if tp.ShutdownDelay > 0 {
+		select {
+		case <-time.After(tp.ShutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	// the HTTP/2 connections, including the h2c ones, receive a GOAWAY and are closed once their streams complete
+	errChan := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errChan <- srv.Shutdown(ctx)
+		}(srv)
+	}
+
+	var shutdownErr error
+	for range servers {
+		if err := <-errChan; err != nil && shutdownErr == nil {
+			shutdownErr = err
+		}
+	}
+
+	// the h2c connections are hijacked, thus not tracked by the servers
+	if shutdownErr == nil {
+		shutdownErr = tp.waitInflight(ctx)
+	}
+
+	// HTTP/3 is closed last, as quic-go cannot close its connections gracefully yet
+	if err := tp.Close(); err != nil && shutdownErr == nil {
+		shutdownErr = err
+	}
+	return shutdownErr
+}
+
+// waitInflight polls the number of requests being served until it drops to zero or the context is done
+func (tp *TorProxy) waitInflight(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&tp.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// countInflight counts the requests being served by the given handler, waited for by Shutdown
+func (tp *TorProxy) countInflight(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&tp.inflight, 1)
+		defer atomic.AddInt64(&tp.inflight, -1)
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (tp *TorProxy) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if !tp.Ready() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready"))
+}
+
+// trackServer registers a server to shut down with the proxy, false is returned if the proxy is already shutting down
+func (tp *TorProxy) trackServer(srv *http.Server) bool {
+	tp.serversMu.Lock()
+	defer tp.serversMu.Unlock()
+
+	if !tp.Ready() {
+		return false
+	}
+	tp.servers = append(tp.servers, srv)
+	return true
+}
+
+// onceCloseListener lets both the server and Close close the listener, only the first call closes it
+type onceCloseListener struct {
+	net.Listener
+	once     sync.Once
+	closeErr error
+}
+
+func (l *onceCloseListener) Close() error {
+	l.once.Do(func() {
+		l.closeErr = l.Listener.Close()
+	})
+	return l.closeErr
+}
@@ -0,0 +1,196 @@
+package torproxy_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// slowOnion serves /slow once released, any other path right away
+func slowOnion(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("done"))
+	})
+}
+
+type result struct {
+	status int
+	body   string
+	err    error
+}
+
+func getAsync(url string) <-chan result {
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		results <- result{status: res.StatusCode, body: string(body), err: err}
+	}()
+	return results
+}
+
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestShutdownDrain(t *testing.T) {
+	const shutdownDelay = 500 * time.Millisecond
+
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, slowOnion(started, release))
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.ShutdownDelay = shutdownDelay
+	if err := tp.ListenAdmin("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	adminReady := "http://" + tp.AdminListener.Addr().String() + torproxy.ReadinessPath
+	srv := httptest.NewServer(tp.Handler())
+	defer srv.Close()
+
+	if status := getStatus(t, adminReady); status != http.StatusOK {
+		t.Fatalf("got readiness status %d before shutting down, want %d", status, http.StatusOK)
+	}
+
+	slow := getAsync(srv.URL + route + "/slow")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownStart := time.Now()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- tp.Shutdown(ctx)
+	}()
+	for tp.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the load balancers are told to stop routing to the proxy, which keeps serving for the delay
+	if status := getStatus(t, adminReady); status != http.StatusServiceUnavailable {
+		t.Errorf("got readiness status %d on the admin listener while draining, want %d", status, http.StatusServiceUnavailable)
+	}
+	// the readiness is only served on the admin listener
+	if status := getStatus(t, srv.URL+torproxy.ReadinessPath); status != http.StatusNotFound {
+		t.Errorf("got status %d for the readiness path on the public listener, want %d", status, http.StatusNotFound)
+	}
+	if status := getStatus(t, srv.URL+route+"/"); status != http.StatusOK {
+		t.Errorf("got status %d during the shutdown delay, want %d", status, http.StatusOK)
+	}
+
+	// the in-flight request holds the shutdown past the delay
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned %v with a request in flight", err)
+	case <-time.After(shutdownDelay + 200*time.Millisecond):
+	}
+
+	close(release)
+	if r := <-slow; r.err != nil || r.status != http.StatusOK || r.body != "done" {
+		t.Fatalf("got %d %q, %v for the in-flight request, want it completed", r.status, r.body, r.err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("got shutdown error %v, want nil", err)
+	}
+	if elapsed := time.Since(shutdownStart); elapsed < shutdownDelay {
+		t.Fatalf("shutdown returned after %v, want after the delay of %v", elapsed, shutdownDelay)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, slowOnion(started, release))
+
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(tp.Handler())
+	defer srv.Close()
+	defer close(release)
+
+	getAsync(srv.URL + route + "/slow")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := tp.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got shutdown error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// failingListener fails to close
+type failingListener struct {
+	net.Listener
+}
+
+func (l failingListener) Close() error {
+	l.Listener.Close()
+	return errors.New("closing failed")
+}
+
+func TestCloseAfterError(t *testing.T) {
+	tp, url, _, closeFunc := reloadProxy(t, nil)
+	defer closeFunc()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.Listeners = append(tp.Listeners, failingListener{lis})
+	if err := tp.ListenAdmin("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	reg := &mutableRegistry{}
+	reg.set(endpoint)
+	if err := tp.WithRegistry(reg); err != nil {
+		t.Fatal(err)
+	}
+	tp.WithAutoUpdater(10*time.Millisecond, func(error) {})
+
+	if err := tp.Close(); err == nil || err.Error() != "closing failed" {
+		t.Fatalf("got close error %v, want the error of the listener", err)
+	}
+
+	// the listeners after the failing one are closed, and the auto-updater is stopped
+	if conn, err := net.Dial("tcp", tp.AdminListener.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("the admin listener still accepts connections after Close")
+	}
+	reg.set(endpoint, "http://"+secondOnionHost+":80")
+	time.Sleep(100 * time.Millisecond)
+	if status := getStatus(t, url+secondRoute+"/"); status != http.StatusNotFound {
+		t.Errorf("got status %d for an onion added to the registry after Close, want %d", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,152 @@
+package torproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// TLSPolicy defines the protocol versions, cipher suites, curves and ALPN protocols of a TLS listener
+// it applies the same way to file-based and CertMagic certificates
+type TLSPolicy struct {
+	MinVersion uint16
+	// MaxVersion is the highest version supported by the std lib if zero
+	MaxVersion uint16
+	// CipherSuites applies to TLS 1.2 and below only, TLS 1.3 suites are not configurable
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	// NextProtos lists the ALPN protocols in order of preference
+	NextProtos []string
+}
+
+// ModernTLSPolicy returns a policy accepting TLS 1.3 only, for clients known to support it
+func ModernTLSPolicy() *TLSPolicy {
+	return &TLSPolicy{
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		NextProtos:       []string{http2.NextProtoTLS, "http/1.1"},
+	}
+}
+
+// IntermediateTLSPolicy returns the default policy accepting TLS 1.2 with forward secret AEAD ciphers and TLS 1.3
+func IntermediateTLSPolicy() *TLSPolicy {
+	return &TLSPolicy{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		NextProtos:       []string{"http/1.1", http2.NextProtoTLS, "h2-14"}, // h2-14 is just for compatibility. will be eventually removed.
+	}
+}
+
+// ParseTLSPolicy returns the TLSPolicy preset matching the given name
+func ParseTLSPolicy(name string) (*TLSPolicy, error) {
+	switch name {
+	case "", "intermediate":
+		return IntermediateTLSPolicy(), nil
+	case "modern":
+		return ModernTLSPolicy(), nil
+	default:
+		return nil, fmt.Errorf("unknown TLS policy %q", name)
+	}
+}
+
+// ParseTLSVersion parses a version like 1.2 or 1.3
+func ParseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+}
+
+// ParseCipherSuites parses a list of cipher suite names as defined by the std lib, eg. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// insecure suites are refused
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if strings.EqualFold(suite.Name, name) {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// ParseCurves parses a list of curve names: X25519, P256, P384 and P521
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		switch strings.ToUpper(strings.Replace(name, "-", "", 1)) {
+		case "X25519":
+			curves = append(curves, tls.X25519)
+		case "P256":
+			curves = append(curves, tls.CurveP256)
+		case "P384":
+			curves = append(curves, tls.CurveP384)
+		case "P521":
+			curves = append(curves, tls.CurveP521)
+		default:
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+	}
+	return curves, nil
+}
+
+func (o *TLSOptions) tlsPolicy() *TLSPolicy {
+	if o.Policy != nil {
+		return o.Policy
+	}
+	return IntermediateTLSPolicy()
+}
+
+// apply sets the policy on the given config
+// the ALPN protocols already in the config, like the ones of the ACME TLS-ALPN challenge, are kept after the policy ones
+func (p *TLSPolicy) apply(config *tls.Config) {
+	config.MinVersion = p.MinVersion
+	config.MaxVersion = p.MaxVersion
+	config.CipherSuites = p.CipherSuites
+	config.CurvePreferences = p.CurvePreferences
+
+	nextProtos := append([]string{}, p.NextProtos...)
+	for _, proto := range config.NextProtos {
+		if !containsString(nextProtos, proto) {
+			nextProtos = append(nextProtos, proto)
+		}
+	}
+	config.NextProtos = nextProtos
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
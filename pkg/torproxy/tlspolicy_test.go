@@ -0,0 +1,147 @@
+package torproxy_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+// policyListener serves the test onion on a TLS listener with the given policy, returning its address and CA
+func policyListener(t *testing.T, policy *torproxy.TLSPolicy) (string, *testCA) {
+	t.Helper()
+
+	ca, dir := newTestCA(t), certificateDir(t)
+	certPath, keyPath := writeCertificate(t, dir, ca.issue(t, "localhost", time.Now().Add(24*time.Hour), "localhost"))
+
+	socks := torproxytest.NewServer()
+	t.Cleanup(socks.Close)
+	socks.AddOnion(onionHost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tp, err := torproxytest.NewTorProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tp.Close() })
+
+	address := freeAddress(t)
+	go tp.ServeListeners([]*torproxy.ListenerOptions{{
+		Address: address,
+		TLS:     &torproxy.TLSOptions{TLSCert: certPath, TLSKey: keyPath, Policy: policy},
+	}})
+	waitListening(t, address)
+	return address, ca
+}
+
+func TestTLSPolicy(t *testing.T) {
+	custom := &torproxy.TLSPolicy{
+		MinVersion:       tls.VersionTLS12,
+		MaxVersion:       tls.VersionTLS12,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+		CurvePreferences: []tls.CurveID{tls.X25519},
+		NextProtos:       []string{"h2"},
+	}
+
+	tests := []struct {
+		name   string
+		policy *torproxy.TLSPolicy
+		client *tls.Config
+		// protocol is the negotiated ALPN protocol, the handshake is expected to fail if empty
+		protocol string
+	}{
+		// the intermediate policy is the default one
+		{"default TLS 1.3", nil, &tls.Config{MinVersion: tls.VersionTLS13, NextProtos: []string{"http/1.1"}}, "http/1.1"},
+		{"default TLS 1.2 AEAD", nil, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, NextProtos: []string{"h2"}}, "h2"},
+		{"default TLS 1.2 CBC", nil, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}}, ""},
+		{"default TLS 1.1", nil, &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, ""},
+		{"intermediate TLS 1.2", torproxy.IntermediateTLSPolicy(), &tls.Config{MaxVersion: tls.VersionTLS12, NextProtos: []string{"http/1.1"}}, "http/1.1"},
+		{"modern TLS 1.3", torproxy.ModernTLSPolicy(), &tls.Config{NextProtos: []string{"http/1.1", "h2"}}, "h2"},
+		{"modern TLS 1.2", torproxy.ModernTLSPolicy(), &tls.Config{MaxVersion: tls.VersionTLS12}, ""},
+		{"custom cipher and curve", custom, &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}, CurvePreferences: []tls.CurveID{tls.X25519}, NextProtos: []string{"h2"}}, "h2"},
+		{"custom TLS 1.3 only client", custom, &tls.Config{MinVersion: tls.VersionTLS13, NextProtos: []string{"h2"}}, ""},
+		{"custom other cipher", custom, &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, NextProtos: []string{"h2"}}, ""},
+		{"custom other curve", custom, &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP256}, NextProtos: []string{"h2"}}, ""},
+		{"custom other ALPN protocol", custom, &tls.Config{NextProtos: []string{"spdy/3"}}, ""},
+	}
+
+	type listener struct {
+		address string
+		ca      *testCA
+	}
+	listeners := make(map[*torproxy.TLSPolicy]listener)
+	for _, tt := range tests {
+		lis, ok := listeners[tt.policy]
+		if !ok {
+			lis.address, lis.ca = policyListener(t, tt.policy)
+			listeners[tt.policy] = lis
+		}
+
+		config := tt.client.Clone()
+		config.RootCAs = lis.ca.pool
+		config.ServerName = "localhost"
+		conn, err := tls.Dial("tcp", lis.address, config)
+		if tt.protocol == "" {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s: got the handshake completed, want it refused", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p := conn.ConnectionState().NegotiatedProtocol; p != tt.protocol {
+			t.Errorf("%s: got ALPN protocol %q, want %q", tt.name, p, tt.protocol)
+		}
+		conn.Close()
+	}
+}
+
+func TestParseTLSPolicy(t *testing.T) {
+	for _, name := range []string{"", "intermediate", "modern"} {
+		if _, err := torproxy.ParseTLSPolicy(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	if _, err := torproxy.ParseTLSPolicy("old"); err == nil {
+		t.Error("got the unknown policy old parsed, want an error")
+	}
+
+	versions := map[string]uint16{"1.2": tls.VersionTLS12, "TLS13": tls.VersionTLS13, "tls1.1": tls.VersionTLS11}
+	for version, want := range versions {
+		got, err := torproxy.ParseTLSVersion(version)
+		if err != nil || got != want {
+			t.Errorf("%q: got version %#x (%v), want %#x", version, got, err, want)
+		}
+	}
+	if _, err := torproxy.ParseTLSVersion("1.4"); err == nil {
+		t.Error("got the unknown version 1.4 parsed, want an error")
+	}
+
+	suites, err := torproxy.ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "tls_ecdhe_rsa_with_chacha20_poly1305_sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suites) != 2 || suites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || suites[1] != tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256 {
+		t.Errorf("got cipher suites %#x", suites)
+	}
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_NOT_A_SUITE"} {
+		if _, err := torproxy.ParseCipherSuites([]string{name}); err == nil {
+			t.Errorf("got the insecure or unknown suite %s parsed, want an error", name)
+		}
+	}
+
+	curves, err := torproxy.ParseCurves([]string{"x25519", "P-256", "P384"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(curves) != 3 || curves[0] != tls.X25519 || curves[1] != tls.CurveP256 || curves[2] != tls.CurveP384 {
+		t.Errorf("got curves %v", curves)
+	}
+	if _, err := torproxy.ParseCurves([]string{"P224"}); err == nil {
+		t.Error("got the unsupported curve P224 parsed, want an error")
+	}
+}
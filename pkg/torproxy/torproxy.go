@@ -1,8 +1,7 @@
 package torproxy
 
 import (
-	"crypto/rand"
-	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,41 +10,149 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/tdex-network/tor-proxy/pkg/registry"
-	"golang.org/x/net/http2"
 	"golang.org/x/net/proxy"
 )
 
+// TorClient is the socks5 interface exposed by a tor client
+// Username and Password are optional, when set they are used to authenticate to the socks5 proxy
 type TorClient struct {
-	Host string
-	Port int
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// Address returns the host:port of the socks5 interface exposed by the tor client
+func (c *TorClient) Address() string {
+	return net.JoinHostPort(c.Host, fmt.Sprint(c.Port))
+}
+
+// Auth returns the socks5 username/password authentication, nil if no credentials are given
+func (c *TorClient) Auth() *proxy.Auth {
+	if c.Username == "" && c.Password == "" {
+		return nil
+	}
+	return &proxy.Auth{User: c.Username, Password: c.Password}
+}
+
+// Dialer returns a socks5 dialer using the credentials of the tor client
+func (c *TorClient) Dialer() (proxy.Dialer, error) {
+	dialer, err := proxy.SOCKS5("tcp", c.Address(), c.Auth(), proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to socks proxy %s: %w", c.Address(), err)
+	}
+	return dialer, nil
 }
 
 // TorProxy holds the tor client details and the list cleartext addresses to be redirect to the onions URLs
 type TorProxy struct {
-	Address   string
-	Domains   []string
-	Client    *TorClient
+	Address string
+	Domains []string
+	Client  *TorClient
+	Pool    *Pool
+	// Dialer is used to connect to the upstream onions, the Pool of tor clients if not given
+	Dialer proxy.ContextDialer
+	// Egress restricts the upstream destinations to onions, a policy is created with the first redirects if not given
+	Egress *EgressPolicy
+	// HeaderPolicy defines the client headers forwarded upstream, PrivacyHeaderPolicy if not given
+	HeaderPolicy *HeaderPolicy
+	// CORSPolicy defines the CORS headers set on the responses, DefaultCORSPolicy if not given
+	CORSPolicy *CORSPolicy
+	// HostRouting enables routing <onion_or_alias>.<base_domain> to the onion at the root path
+	HostRouting *HostRoutingOptions
+	// AllowedClients lists the subjects of the verified client certificates allowed to access the routes
+	// all clients are allowed if empty, see ClientAuthOptions to enable mutual TLS
+	AllowedClients []string
+	// AccessLog logs every request with the identity of the verified client, disabled if nil
+	AccessLog *log.Logger
+	// Metrics collects the Prometheus metrics, disabled if nil, see WithMetrics
+	Metrics *Metrics
+	// Routes holds the per-route options keyed by onion host, see WithRouteOptions
+	Routes    map[string]*RouteOptions
 	Registry  registry.Registry
 	Redirects []*url.URL
-
-	Listener             net.Listener
-	useTLS               bool
-	closeAutoUpdaterFunc func()
+	// ShutdownDelay is how long Shutdown keeps serving as not ready before closing the listeners
+	ShutdownDelay time.Duration
+
+	// Listener is the first of Listeners, kept for compatibility
+	Listener     net.Listener
+	Listeners    []net.Listener
+	HTTPListener net.Listener
+	// AdminListener serves the readiness and the metrics, see ListenAdmin
+	AdminListener          net.Listener
+	OnionService           *OnionService
+	useTLS                 bool
+	closeAutoUpdaterFunc   func()
+	certLoaders            []*CertificateLoader
+	certLoadersMu          sync.Mutex
+	certCaches             []*certmagic.Cache
+	http3Servers           []http3Server
+	hostRouter             atomic.Value
+	registryAliases        map[string]string
+	registryClearnet       []string
+	router                 atomic.Value
+	configMu               sync.Mutex
+	autoUpdatePeriod       time.Duration
+	autoUpdateErrorHandler func(err error)
+	servers                []*http.Server
+	serversMu              sync.Mutex
+	draining               int32
+	inflight               int64
 }
 
 // NewTorProxyFromHostAndPort returns a *TorProxy with givnen host and port
 func NewTorProxyFromHostAndPort(torHost string, torPort int) (*TorProxy, error) {
+	return NewTorProxyFromClients([]*TorClient{{Host: torHost, Port: torPort}}, RoundRobin)
+}
+
+// NewTorProxyFromClient returns a *TorProxy using the given tor client, including its credentials
+func NewTorProxyFromClient(client *TorClient) (*TorProxy, error) {
+	return NewTorProxyFromClients([]*TorClient{client}, RoundRobin)
+}
 
-	// dial to check if socks5 proxy is listening
-	dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("%s:%d", torHost, torPort), nil, proxy.Direct)
+// NewTorProxyFromClients returns a *TorProxy balancing the upstream connections over the given tor clients
+// every client is checked at startup, the ones not able to reach the tor network are left out of rotation
+func NewTorProxyFromClients(clients []*TorClient, strategy BalancingStrategy) (*TorProxy, error) {
+	pool, err := NewPool(clients, strategy)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't connect to socks proxy: %w", err)
+		return nil, err
 	}
 
+	var reachable int
+	for _, b := range pool.backends {
+		if err := checkTorConnection(b.dialer); err != nil {
+			log.Printf("socks5 backend %s: %s", b.client.Address(), err)
+			b.setHealthy(false)
+			continue
+		}
+		reachable++
+	}
+	if reachable == 0 {
+		return nil, ErrNoHealthyBackend
+	}
+
+	return &TorProxy{
+		Client: clients[0],
+		Pool:   pool,
+	}, nil
+}
+
+// NewTorProxyWithDialer returns a *TorProxy connecting to the upstream onions with the given dialer
+// no check is performed on the dialer, for instance an *OverrideDialer can be used to target local daemons
+func NewTorProxyWithDialer(dialer proxy.ContextDialer) *TorProxy {
+	return &TorProxy{
+		Dialer: dialer,
+	}
+}
+
+// checkTorConnection makes a request through the given dialer to check the socks5 proxy is listening
+func checkTorConnection(dialer proxy.Dialer) error {
 	tr := &http.Transport{Dial: dialer.Dial}
 	c := &http.Client{
 		Transport: tr,
@@ -53,20 +160,15 @@ func NewTorProxyFromHostAndPort(torHost string, torPort int) (*TorProxy, error)
 
 	req, err := http.NewRequest(http.MethodGet, "https://check.torproject.org", nil)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't create request : %w", err)
+		return fmt.Errorf("couldn't create request : %w", err)
 	}
 
 	_, err = c.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't make request: %w", err)
+		return fmt.Errorf("couldn't make request: %w", err)
 	}
 
-	return &TorProxy{
-		Client: &TorClient{
-			Host: torHost,
-			Port: torPort,
-		},
-	}, nil
+	return nil
 }
 
 func (tp *TorProxy) WithRegistry(regis registry.Registry) error {
@@ -82,235 +184,352 @@ func (tp *TorProxy) WithRegistry(regis registry.Registry) error {
 // WithRedirects modify the TorProxy struct with givend from -> to map
 // add the redirect URL if and only if the tor proxy doesn't know the new origin
 func (tp *TorProxy) setRedirectsFromRegistry(registryJSON []byte) error {
-	redirects, err := parseRegistryJSONtoRedirects(registryJSON)
+	table, err := parseRegistry(registryJSON)
 	if err != nil {
 		return err
 	}
 
-	for _, to := range redirects {
-		// we parse the destination upstram which should be on *.onion address
-		origin, err := url.Parse(to)
-		if err != nil {
-			return fmt.Errorf("failed to parse address : %v", err)
+	tp.configMu.Lock()
+	defer tp.configMu.Unlock()
+
+	redirects := append([]*url.URL{}, tp.Redirects...)
+	for _, origin := range table.redirects {
+		if !includesRedirect(redirects, origin) {
+			redirects = append(redirects, origin)
 		}
+	}
+	// the onions are never removed by the updates, an onion already served on another port is refused
+	if err := checkRoutes(redirects); err != nil {
+		return err
+	}
 
-		if !tp.includesRedirect(origin) {
-			tp.Redirects = append(tp.Redirects, origin)
+	for _, host := range table.clearnet {
+		tp.egressPolicy().AllowClearnet(host)
+		if !containsString(tp.registryClearnet, host) {
+			tp.registryClearnet = append(tp.registryClearnet, host)
 		}
 	}
 
-	return err
-}
+	for label, onion := range table.aliases {
+		if tp.registryAliases == nil {
+			tp.registryAliases = make(map[string]string)
+		}
+		tp.registryAliases[label] = onion
+	}
 
-func (tp TorProxy) includesRedirect(redirect *url.URL) bool {
-	for _, proxyRedirect := range tp.Redirects {
-		if proxyRedirect.Host == redirect.Host {
-			return true
+	previous := tp.Redirects
+	tp.Redirects = redirects
+
+	// serve the new onions right away if already serving
+	if tp.router.Load() != nil {
+		if err := tp.buildRouter(); err != nil {
+			tp.Redirects = previous
+			return err
 		}
 	}
 
-	return false
+	return nil
 }
 
 // WithAutoUpdater starts a go-routine selecting results of registry.Observe
 // set up a stop function in TorProxy to stop the go-routine in Close method
 func (tp *TorProxy) WithAutoUpdater(period time.Duration, errorHandler func(err error)) {
-	observeRegistryChan, stop := registry.Observe(tp.Registry, period)
+	tp.autoUpdatePeriod = period
+	tp.autoUpdateErrorHandler = errorHandler
+	tp.startAutoUpdater()
+}
+
+func (tp *TorProxy) startAutoUpdater() {
+	observeRegistryChan, stop := registry.Observe(tp.Registry, tp.autoUpdatePeriod)
+	stopped := make(chan struct{})
 
 	go func() {
+		defer close(stopped)
 		for newGetJSONResult := range observeRegistryChan {
 			if newGetJSONResult.Err != nil {
-				errorHandler(newGetJSONResult.Err)
+				tp.Metrics.registryUpdate(newGetJSONResult.Err)
+				tp.autoUpdateErrorHandler(newGetJSONResult.Err)
 				continue
 			}
 
 			err := tp.setRedirectsFromRegistry(newGetJSONResult.Json)
+			tp.Metrics.registryUpdate(err)
 			if err != nil {
-				errorHandler(err)
+				tp.autoUpdateErrorHandler(err)
 			}
 		}
 	}()
 
-	tp.closeAutoUpdaterFunc = stop
+	// the stop function returns once the last fetched registry, if any, has been applied
+	tp.closeAutoUpdaterFunc = func() {
+		stop()
+		<-stopped
+	}
 }
 
 // TLSOptions defines the domains we need to obtain and renew a TLS cerficate
+// Domains may include wildcards like *.example.com, which require a DNS-01 challenge.
+// If HTTPAddress is given, a plain HTTP listener answers the ACME HTTP-01 challenges and redirects everything else to HTTPS
 type TLSOptions struct {
 	Domains    []string
 	Email      string
 	UseStaging bool
-	TLSKey     string
-	TLSCert    string
+	// CA is the ACME directory URL, eg. ZeroSSL or an internal step-ca, Let's Encrypt (or its staging with UseStaging) if empty
+	CA string
+	// CARoots are trusted to connect to the ACME directory, the system roots if nil
+	CARoots *x509.CertPool
+	// EABKeyID and EABMACKey (base64url) bind the ACME account to an external account, as required by ZeroSSL
+	EABKeyID  string
+	EABMACKey string
+	// DNSProvider solves DNS-01 challenges, allowing certificates for wildcards and proxies unreachable by the CA
+	// HTTP-01 and TLS-ALPN-01 challenges are disabled when set, see RFC2136Provider
+	DNSProvider certmagic.ACMEDNSProvider
+	// StorageDir is where certificates and ACME accounts are stored, ignored if Storage is given
+	// CertMagic default $HOME/.local/share/certmagic (or $XDG_DATA_HOME/certmagic) if empty
+	StorageDir string
+	// Storage is a custom backend, eg. shared by several replicas of the proxy
+	Storage     certmagic.Storage
+	TLSKey      string
+	TLSCert     string
+	HTTPAddress string
+	// OnDemand defers obtaining the certificates to the first TLS handshake of each name
+	// approved by DecisionFunc, or matching Domains and AllowedDomains if not given
+	OnDemand       bool
+	AllowedDomains []string
+	DecisionFunc   func(name string) error
+	// Policy defines the versions, ciphers, curves and ALPN protocols, IntermediateTLSPolicy if nil
+	Policy *TLSPolicy
+	// ClientAuth enables mutual TLS, the clients are not asked for a certificate if nil
+	ClientAuth *ClientAuthOptions
+	// CertWatchPeriod is how often TLSKey and TLSCert are checked for changes, DefaultCertificateWatchPeriod if zero
+	CertWatchPeriod time.Duration
 }
 
 // Serve starts a HTTP/1.x reverse proxy for all cleartext requests to the registered Onion addresses.
 // An address to listent for TCP packets must be given.
 // TLS will be enabled if a non-nil *TLSOptions is given. CertMagic will obtain, store and renew certificates for the domains.
-// By default, CertMagic stores assets on the local file system in $HOME/.local/share/certmagic (and honors $XDG_DATA_HOME if set).
+// By default, CertMagic stores assets on the local file system in $HOME/.local/share/certmagic (and honors $XDG_DATA_HOME if set),
+// use StorageDir or a custom Storage to change it.
 // CertMagic will create the directory if it does not exist.
 // If writes are denied, things will not be happy, so make sure CertMagic can write to it!
 // For each onion address we get to know thanks the WithRedirects method, we register a URL.path like
 // host:port/<just_onion_host_without_dot_onion>/[<grpc_package>.<grpc_service>/<grpc_method>]
 // Each incoming request will be proxied to <just_onion_host_without_dot_onion>.onion/[<grpc_package>.<grpc_service>/<grpc_method>]
+// If the proxy has been published as onion service with WithOnionService, the same routes are served on it too.
+// In that case the address can be left empty to serve on the onion service only.
+// Use ServeListeners to serve on several listeners at once.
 func (tp *TorProxy) Serve(address string, options *TLSOptions) error {
+	if address == "" {
+		return tp.ServeListeners(nil)
+	}
 
-	if options != nil {
-
-		var tlsConfig *tls.Config
+	return tp.ServeListeners([]*ListenerOptions{{Address: address, TLS: options}})
+}
 
-		// if key and certificate filesystem paths are given, do NOT use certmagic.
-		if len(options.TLSKey) > 0 && len(options.TLSCert) > 0 {
-			certificate, err := tls.LoadX509KeyPair(options.TLSCert, options.TLSKey)
-			if err != nil {
-				return err
-			}
+// Close stops the proxy at once, breaking the in-flight requests, see Shutdown to drain them first
+// everything is closed even if closing a listener fails, the first error is returned
+func (tp *TorProxy) Close() error {
+	tp.serversMu.Lock()
+	atomic.StoreInt32(&tp.draining, 1)
+	servers := tp.servers
+	tp.serversMu.Unlock()
+
+	var closeErr error
+	keepFirst := func(err error) {
+		if err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
 
-			tlsConfig = &tls.Config{
-				MinVersion:   tls.VersionTLS12,
-				NextProtos:   []string{"http/1.1", http2.NextProtoTLS, "h2-14"}, // h2-14 is just for compatibility. will be eventually removed.
-				Certificates: []tls.Certificate{certificate},
-				CipherSuites: []uint16{
-					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				},
-			}
-			tlsConfig.Rand = rand.Reader
-		} else {
+	for _, srv := range servers {
+		keepFirst(srv.Close())
+	}
 
-			// read and agree to your CA's legal documents
-			certmagic.DefaultACME.Agreed = true
+	for _, lis := range tp.Listeners {
+		keepFirst(lis.Close())
+	}
 
-			// provide an email address
-			if len(options.Email) > 0 {
-				certmagic.DefaultACME.Email = options.Email
-			}
-			// use the staging endpoint while we're developing
-			if options.UseStaging {
-				certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
-			}
+	for _, h3 := range tp.http3Servers {
+		keepFirst(h3.Close())
+	}
 
-			// config
-			tlsConfig, err := certmagic.TLS(options.Domains)
-			if err != nil {
-				return err
-			}
-			tlsConfig.NextProtos = []string{"http/1.1", http2.NextProtoTLS, "h2-14"} // h2-14 is just for compatibility. will be eventually removed.
-		}
+	if tp.HTTPListener != nil {
+		keepFirst(tp.HTTPListener.Close())
+	}
 
-		// get a TLS listener
-		lis, err := tls.Listen("tcp", address, tlsConfig)
-		if err != nil {
-			return err
-		}
+	if tp.AdminListener != nil {
+		keepFirst(tp.AdminListener.Close())
+	}
 
-		// Set address and listener
-		tp.Address = address
-		tp.Listener = lis
-		// Set with TLS stuff
-		tp.Domains = options.Domains
-		tp.useTLS = true
-	} else {
+	if tp.OnionService != nil {
+		keepFirst(tp.OnionService.Close())
+	}
 
-		lis, err := net.Listen("tcp", address)
-		if err != nil {
-			return err
-		}
+	// the auto-updater can only be stopped once
+	if tp.closeAutoUpdaterFunc != nil {
+		tp.closeAutoUpdaterFunc()
+		tp.closeAutoUpdaterFunc = nil
+	}
 
-		// Set address and listener
-		tp.Address = address
-		tp.Listener = lis
+	for _, loader := range tp.loaders() {
+		loader.Close()
 	}
 
-	// Create a socks5 dialer
-	dialer, err := proxy.SOCKS5("tcp", fmt.Sprintf("%s:%d", tp.Client.Host, tp.Client.Port), nil, proxy.Direct)
-	if err != nil {
-		log.Fatalf("couldn't connect to socks proxy: %s", err.Error())
+	for _, cache := range tp.certCaches {
+		cache.Stop()
 	}
+	tp.certCaches = nil
 
-	// Now we can reverse proxy all the redirects
-	if err := reverseProxy(tp.Redirects, tp.Listener, dialer); err != nil {
-		return err
+	if tp.Pool != nil {
+		tp.Pool.Close()
 	}
 
-	return err
+	return closeErr
 }
 
-func (tp *TorProxy) Close() error {
-	err := tp.Listener.Close()
-	if err != nil {
-		return err
+// Handler returns the router proxying the requests to the registered onions
+// if host routing is enabled with WithHostRouting, <onion_or_alias>.<base_domain> is routed to the onion at the root path
+// the routes are rebuilt by Reload and by the registry auto-updater, the handler always serves the latest ones
+func (tp *TorProxy) Handler() http.Handler {
+	tp.configMu.Lock()
+	if err := tp.buildRouter(); err != nil {
+		// the redirects given without registry are not validated, nothing is served rather than panicking
+		log.Printf("building the routes: %v", err)
+		if tp.router.Load() == nil {
+			tp.router.Store(routerHolder{http.NotFoundHandler()})
+		}
 	}
+	tp.configMu.Unlock()
 
-	if tp.closeAutoUpdaterFunc != nil {
-		tp.closeAutoUpdaterFunc()
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp.router.Load().(routerHolder).ServeHTTP(w, r)
+	})
+
+	if tp.AccessLog != nil {
+		handler = accessLog(tp.AccessLog, handler)
 	}
+	if tp.AccessLog != nil || tp.Metrics != nil {
+		handler = observeGRPC(handler)
+	}
+	return tp.countInflight(handler)
+}
 
-	return nil
+// dialer returns the dialer used to connect to the upstream onions, guarded by the egress policy
+func (tp *TorProxy) dialer() proxy.ContextDialer {
+	var dialer proxy.ContextDialer = tp.Pool
+	if tp.Dialer != nil {
+		dialer = tp.Dialer
+	}
+	return tp.egressPolicy().Dialer(tp.Metrics.dialer(dialer))
+}
+
+func (tp *TorProxy) egressPolicy() *EgressPolicy {
+	if tp.Egress == nil {
+		tp.Egress = NewEgressPolicy()
+	}
+	return tp.Egress
 }
 
-// reverseProxy takes an address where to listen, a dialer with SOCKS5 proxy and a list of redirects as a list of URLs
+// reverseProxy takes a dialer with SOCKS5 proxy and a list of redirects as a list of URLs and returns the router
 // the incoming request should match the pattern host:port/<just_onion_host_without_dot_onion>/<grpc_package>.<grpc_service>/<grpc_method>
-func reverseProxy(redirects []*url.URL, lis net.Listener, dialer proxy.Dialer) error {
+// it also returns the handlers serving each onion at the root path, keyed by <just_onion_host_without_dot_onion>
+// an error is returned if two redirects share the same route, as http.ServeMux would panic registering them
+func reverseProxy(redirects []*url.URL, dialer proxy.ContextDialer, routeOptions func(*url.URL) *RouteOptions, metrics *Metrics) (*http.ServeMux, map[string]http.Handler, error) {
+	if err := checkRoutes(redirects); err != nil {
+		return nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	hosts := make(map[string]http.Handler, len(redirects))
 
 	for _, to := range redirects {
 		removeForUpstream := "/" + withoutOnion(to.Host)
+		options := routeOptions(to)
 
 		// get a simple reverse proxy
-		revproxy := generateReverseProxy(to, dialer)
+		revproxy := generateReverseProxy(to, dialer, options.Headers, metrics)
 
-		http.HandleFunc(removeForUpstream+"/", func(w http.ResponseWriter, r *http.Request) {
+		route := withoutOnion(to.Host)
+		mux.Handle(removeForUpstream+"/", metrics.instrument(route, routeHandler(revproxy, options, removeForUpstream)))
+		hosts[route] = metrics.instrument(route, routeHandler(revproxy, options, ""))
+	}
 
-			// add cors headers
-			addCorsHeader(w, r)
+	return mux, hosts, nil
+}
 
-			// Handler pre-flight requests
-			if r.Method == http.MethodOptions {
-				return
-			}
+// routeHandler proxies the requests with the given reverse proxy, removing the path prefix if not empty
+func routeHandler(revproxy http.Handler, options *RouteOptions, removeForUpstream string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-			// prepare request removing useless headers
-			if err := prepareRequest(r); err != nil {
-				http.Error(w, fmt.Errorf("preparation request in reverse proxy: %w", err).Error(), http.StatusInternalServerError)
-				return
-			}
+		// answer the pre-flight requests before checking the client, they are never forwarded to the onion
+		if isPreflight(r) {
+			options.CORS.handle(w, r)
+			return
+		}
+
+		// refuse the clients without a verified certificate allowed on this route
+		if !isClientAllowed(r, options.AllowedClients) {
+			http.Error(w, "client not allowed", http.StatusForbidden)
+			return
+		}
+
+		// add cors headers and handle pre-flight requests
+		if preflight := options.CORS.handle(w, r); preflight {
+			return
+		}
+
+		// prepare request removing useless headers
+		if err := prepareRequest(r, options.Headers); err != nil {
+			http.Error(w, fmt.Errorf("preparation request in reverse proxy: %w", err).Error(), http.StatusInternalServerError)
+			return
+		}
 
-			// remove the <just_onion_host_without_dot_onion> from the upstream path
+		// remove the <just_onion_host_without_dot_onion> from the upstream path
+		if removeForUpstream != "" {
 			pathWithOnion := r.URL.Path
 			pathWithoutOnion := strings.ReplaceAll(pathWithOnion, removeForUpstream, "")
 			r.URL.Path = pathWithoutOnion
+		}
 
-			revproxy.ServeHTTP(w, r)
-		})
+		revproxy.ServeHTTP(w, r)
 	}
-
-	return http.Serve(lis, nil)
 }
 
 func withoutOnion(host string) string {
-	hostWithoutPort, _, _ := net.SplitHostPort(host)
+	hostWithoutPort, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostWithoutPort = host
+	}
 	return strings.ReplaceAll(hostWithoutPort, ".onion", "")
 }
 
-func addCorsHeader(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodOptions {
-		return
-	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
+// registryEntry is an endpoint of the registry
+// clearnet upstreams are accepted only if the entry explicitly opts-in with "clearnet": true
+// an alias can be given to route <alias>.<base_domain> to the endpoint with host routing
+type registryEntry struct {
+	Endpoint string `json:"endpoint"`
+	Clearnet bool   `json:"clearnet"`
+	Alias    string `json:"alias"`
 }
 
-func parseRegistryJSONtoRedirects(registryJSON []byte) ([]string, error) {
-	var data []map[string]string
+func parseRegistryJSONtoRedirects(registryJSON []byte) ([]registryEntry, error) {
+	var data []registryEntry
 	err := json.Unmarshal(registryJSON, &data)
 	if err != nil {
 		return nil, fmt.Errorf("invalid JSON: %w", err)
 	}
-	redirects := make([]string, 0)
+	redirects := make([]registryEntry, 0)
 	for _, v := range data {
-		if strings.Contains(v["endpoint"], "onion") {
-			redirects = append(redirects, v["endpoint"])
+		u, err := url.Parse(v.Endpoint)
+		if err != nil || u.Hostname() == "" {
+			log.Printf("skipping invalid endpoint %q", v.Endpoint)
+			continue
+		}
+		if !isOnionHost(strings.ToLower(u.Hostname())) && !v.Clearnet {
+			log.Printf("skipping clearnet endpoint %s without explicit opt-in", v.Endpoint)
+			continue
 		}
+		redirects = append(redirects, v)
 	}
 	if len(redirects) == 0 {
 		return nil, errors.New("no valid onion endpoints found")
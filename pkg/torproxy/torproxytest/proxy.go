@@ -0,0 +1,89 @@
+package torproxytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+
+	"github.com/tdex-network/tor-proxy/pkg/registry"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Proxy is a TorProxy served on a random localhost port and dialing the onions through a fake SOCKS5 server
+type Proxy struct {
+	*torproxy.TorProxy
+	Server *httptest.Server
+	// URL is the base URL of the proxy, of form http://127.0.0.1:port
+	URL string
+}
+
+// NewProxy returns a started *Proxy routing to the given onion endpoints, eg. http://<onion>.onion:80
+// through the given fake SOCKS5 server
+// as the plaintext listeners of the proxy, it serves both HTTP/1.x and HTTP/2 cleartext (gRPC)
+func NewProxy(socks *Server, endpoints ...string) (*Proxy, error) {
+	tp, err := NewTorProxy(socks, endpoints...)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := httptest.NewServer(h2c.NewHandler(tp.Handler(), &http2.Server{}))
+	return &Proxy{TorProxy: tp, Server: srv, URL: srv.URL}, nil
+}
+
+// NewTLSProxy is like NewProxy but serves with TLS, see httptest.NewTLSServer
+func NewTLSProxy(socks *Server, endpoints ...string) (*Proxy, error) {
+	tp, err := NewTorProxy(socks, endpoints...)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := httptest.NewUnstartedServer(tp.Handler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return &Proxy{TorProxy: tp, Server: srv, URL: srv.URL}, nil
+}
+
+// Close shuts down the proxy server
+func (p *Proxy) Close() {
+	p.Server.Close()
+	p.TorProxy.Pool.Close()
+}
+
+// NewTorProxy returns a *torproxy.TorProxy with the given endpoints as registry, dialing through the fake SOCKS5 server
+// the startup check against the tor network is skipped
+func NewTorProxy(socks *Server, endpoints ...string) (*torproxy.TorProxy, error) {
+	pool, err := torproxy.NewPool([]*torproxy.TorClient{socks.TorClient()}, torproxy.RoundRobin)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := torproxy.NewTorProxyWithDialer(pool)
+	tp.Pool = pool
+
+	reg, err := RegistryFromEndpoints(endpoints...)
+	if err != nil {
+		return nil, err
+	}
+	if err := tp.WithRegistry(reg); err != nil {
+		return nil, err
+	}
+
+	return tp, nil
+}
+
+// RegistryFromEndpoints returns a constant registry listing the given endpoints
+func RegistryFromEndpoints(endpoints ...string) (registry.Registry, error) {
+	entries := make([]map[string]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		entries = append(entries, map[string]string{"endpoint": e})
+	}
+
+	registryJSON, err := json.Marshal(entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoints: %w", err)
+	}
+
+	return registry.NewRegistry(string(registryJSON))
+}
@@ -0,0 +1,380 @@
+// Package torproxytest provides utilities to test the tor proxy without tor:
+// an in-process SOCKS5 server resolving fake onions to in-memory HTTP/gRPC handlers
+// and helpers to spin up a fully configured TorProxy against it.
+package torproxytest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Reply is a SOCKS5 reply code, including the extended codes sent by tor for onion services
+type Reply byte
+
+const (
+	ReplySucceeded               Reply = 0x00
+	ReplyGeneralFailure          Reply = 0x01
+	ReplyNotAllowed              Reply = 0x02
+	ReplyNetworkUnreachable      Reply = 0x03
+	ReplyHostUnreachable         Reply = 0x04
+	ReplyConnectionRefused       Reply = 0x05
+	ReplyTTLExpired              Reply = 0x06
+	ReplyCommandNotSupported     Reply = 0x07
+	ReplyAddressNotSupported     Reply = 0x08
+	ReplyOnionDescriptorNotFound Reply = 0xF0
+	ReplyOnionDescriptorInvalid  Reply = 0xF1
+	ReplyOnionIntroFailed        Reply = 0xF2
+	ReplyOnionRendezvousFailed   Reply = 0xF3
+	ReplyOnionMissingClientAuth  Reply = 0xF4
+	ReplyOnionWrongClientAuth    Reply = 0xF5
+	ReplyOnionBadAddress         Reply = 0xF6
+	ReplyOnionIntroTimedOut      Reply = 0xF7
+)
+
+type onion struct {
+	listener *connListener
+	server   *http.Server
+	reply    Reply
+	delay    time.Duration
+}
+
+// Server is an in-process SOCKS5 server resolving fake onions to in-memory handlers
+// unknown onions are answered with ReplyOnionDescriptorNotFound, as tor does
+type Server struct {
+	// Username and Password, when set before the first connection, are required from the clients
+	Username string
+	Password string
+
+	listener net.Listener
+
+	mu     sync.RWMutex
+	onions map[string]*onion
+	wg     sync.WaitGroup
+}
+
+// NewServer starts a SOCKS5 server listening on a random localhost port
+func NewServer() *Server {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("torproxytest: failed to listen on a port: %v", err))
+	}
+
+	s := &Server{
+		listener: lis,
+		onions:   make(map[string]*onion),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Addr returns the host:port the SOCKS5 server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// TorClient returns the *torproxy.TorClient connecting to the server
+func (s *Server) TorClient() *torproxy.TorClient {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return &torproxy.TorClient{
+		Host:     addr.IP.String(),
+		Port:     addr.Port,
+		Username: s.Username,
+		Password: s.Password,
+	}
+}
+
+// AddOnion serves the handler on the given onion host, both HTTP/1.x and HTTP/2 cleartext (gRPC) are supported
+// the port of the destination is ignored
+func (s *Server) AddOnion(host string, handler http.Handler) {
+	lis := newConnListener()
+	srv := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go srv.Serve(lis)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.onions[onionKey(host)]
+	if !ok {
+		o = &onion{}
+		s.onions[onionKey(host)] = o
+	}
+	if o.server != nil {
+		o.server.Close()
+	}
+	o.listener = lis
+	o.server = srv
+	o.reply = ReplySucceeded
+}
+
+// InjectError makes the server answer the CONNECT requests to the onion with the given reply
+// use ReplySucceeded to restore the normal behavior, calling AddOnion restores it too
+func (s *Server) InjectError(host string, reply Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.onionLocked(host)
+	o.reply = reply
+}
+
+// SetDelay delays the reply to the CONNECT requests to the onion, to simulate slow circuits
+func (s *Server) SetDelay(host string, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.onionLocked(host)
+	o.delay = delay
+}
+
+// Close stops the server and all the onion handlers
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.onions {
+		if o.server != nil {
+			o.server.Close()
+		}
+	}
+}
+
+// onionLocked returns the onion for the host, registering one without handler if needed
+func (s *Server) onionLocked(host string) *onion {
+	o, ok := s.onions[onionKey(host)]
+	if !ok {
+		o = &onion{reply: ReplyOnionDescriptorNotFound}
+		s.onions[onionKey(host)] = o
+	}
+	return o
+}
+
+func (s *Server) lookup(host string) (*onion, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.onions[onionKey(host)]
+	if !ok {
+		return nil, false
+	}
+	cp := *o
+	return &cp, true
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	host, err := s.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	reply := ReplyOnionDescriptorNotFound
+	o, ok := s.lookup(host)
+	if ok {
+		time.Sleep(o.delay)
+		reply = o.reply
+		if o.listener == nil && reply == ReplySucceeded {
+			reply = ReplyOnionDescriptorNotFound
+		}
+	}
+	if !strings.HasSuffix(onionKey(host), ".onion") {
+		reply = ReplyHostUnreachable
+	}
+
+	if _, err := conn.Write([]byte{0x05, byte(reply), 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil || reply != ReplySucceeded {
+		conn.Close()
+		return
+	}
+
+	if !o.listener.push(conn) {
+		conn.Close()
+	}
+}
+
+// handshake negotiates the authentication and reads the CONNECT request, returning the destination host
+func (s *Server) handshake(conn net.Conn) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return "", err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != 0x05 {
+		return "", errors.New("unsupported socks version")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(0x00)
+	if s.Username != "" || s.Password != "" {
+		method = 0x02
+	}
+	if !containsByte(methods, method) {
+		conn.Write([]byte{0x05, 0xFF})
+		return "", errors.New("no acceptable authentication methods")
+	}
+	if _, err := conn.Write([]byte{0x05, method}); err != nil {
+		return "", err
+	}
+	if method == 0x02 {
+		if err := s.authenticate(conn); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != 0x01 {
+		conn.Write([]byte{0x05, byte(ReplyCommandNotSupported), 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("unsupported command")
+	}
+
+	var host string
+	switch request[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == 0x04 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		conn.Write([]byte{0x05, byte(ReplyAddressNotSupported), 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return "", errors.New("unsupported address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// authenticate performs the RFC 1929 username/password sub-negotiation
+func (s *Server) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		return err
+	}
+	password := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if string(username) != s.Username || string(password) != s.Password {
+		conn.Write([]byte{0x01, 0x01})
+		return errors.New("username/password authentication failed")
+	}
+
+	_, err := conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+func onionKey(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func containsByte(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// connListener is a net.Listener accepting the connections pushed by the SOCKS5 server
+type connListener struct {
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("torproxytest: listener closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
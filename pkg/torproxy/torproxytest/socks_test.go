@@ -0,0 +1,253 @@
+package torproxytest_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tdex-network/tor-proxy/pkg/torproxy"
+	"github.com/tdex-network/tor-proxy/pkg/torproxy/torproxytest"
+)
+
+const (
+	onionHost = "torproxytestonionserviceaaaatorproxytestonionserviceaaaa.onion"
+	endpoint  = "http://" + onionHost + ":80"
+	// route is the path prefix of the onion on the proxy
+	route = "/torproxytestonionserviceaaaatorproxytestonionserviceaaaa"
+)
+
+func pathHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading the body of %s: %v", url, err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestProxy(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, pathHandler())
+
+	p, err := torproxytest.NewProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	status, body := get(t, http.DefaultClient, p.URL+route+"/v1/market")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d, want %d", status, http.StatusOK)
+	}
+	// the onion prefix is removed from the upstream path
+	if body != "/v1/market" {
+		t.Fatalf("got upstream path %q, want %q", body, "/v1/market")
+	}
+}
+
+func TestTLSProxy(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, pathHandler())
+
+	p, err := torproxytest.NewTLSProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	res, err := p.Server.Client().Get(p.URL + route + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if res.ProtoMajor != 2 {
+		t.Fatalf("got %s, want HTTP/2", res.Proto)
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	replies := []torproxytest.Reply{
+		torproxytest.ReplyGeneralFailure,
+		torproxytest.ReplyNotAllowed,
+		torproxytest.ReplyNetworkUnreachable,
+		torproxytest.ReplyHostUnreachable,
+		torproxytest.ReplyConnectionRefused,
+		torproxytest.ReplyTTLExpired,
+		torproxytest.ReplyCommandNotSupported,
+		torproxytest.ReplyAddressNotSupported,
+		torproxytest.ReplyOnionDescriptorNotFound,
+		torproxytest.ReplyOnionDescriptorInvalid,
+		torproxytest.ReplyOnionIntroFailed,
+		torproxytest.ReplyOnionRendezvousFailed,
+		torproxytest.ReplyOnionMissingClientAuth,
+		torproxytest.ReplyOnionWrongClientAuth,
+		torproxytest.ReplyOnionBadAddress,
+		torproxytest.ReplyOnionIntroTimedOut,
+	}
+
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, pathHandler())
+
+	p, err := torproxytest.NewProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, reply := range replies {
+		socks.InjectError(onionHost, reply)
+
+		if status, _ := get(t, http.DefaultClient, p.URL+route+"/"); status != http.StatusBadGateway {
+			t.Errorf("reply %#x: got status %d, want %d", byte(reply), status, http.StatusBadGateway)
+		}
+		// the tor client answered, it must stay in rotation
+		if n := len(p.Pool.Healthy()); n != 1 {
+			t.Errorf("reply %#x: got %d healthy tor clients, want 1", byte(reply), n)
+		}
+	}
+
+	socks.InjectError(onionHost, torproxytest.ReplySucceeded)
+	if status, _ := get(t, http.DefaultClient, p.URL+route+"/"); status != http.StatusOK {
+		t.Fatalf("got status %d after restoring the onion, want %d", status, http.StatusOK)
+	}
+}
+
+func TestUnknownOnion(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+
+	p, err := torproxytest.NewProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if status, _ := get(t, http.DefaultClient, p.URL+route+"/"); status != http.StatusBadGateway {
+		t.Fatalf("got status %d, want %d", status, http.StatusBadGateway)
+	}
+}
+
+func TestSetDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, pathHandler())
+	socks.SetDelay(onionHost, delay)
+
+	p, err := torproxytest.NewProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	start := time.Now()
+	if status, _ := get(t, http.DefaultClient, p.URL+route+"/"); status != http.StatusOK {
+		t.Fatalf("got status %d, want %d", status, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("got a response after %v, want at least %v", elapsed, delay)
+	}
+}
+
+func TestSetDelayTimeout(t *testing.T) {
+	socks := torproxytest.NewServer()
+	defer socks.Close()
+	socks.AddOnion(onionHost, pathHandler())
+	socks.SetDelay(onionHost, 2*time.Second)
+
+	p, err := torproxytest.NewProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// the dial through the pool is canceled with the request
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := p.Pool.DialContext(ctx, "tcp", onionHost+":80"); err == nil {
+		t.Fatal("dialed the slow onion, want a timeout")
+	}
+	if n := len(p.Pool.Healthy()); n != 1 {
+		t.Fatalf("got %d healthy tor clients after a timeout, want 1", n)
+	}
+
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := client.Get(p.URL + route + "/"); err == nil {
+		t.Fatal("got a response from the slow onion, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the client timed out after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestSOCKSAuth(t *testing.T) {
+	socks := torproxytest.NewServer()
+	socks.Username = "torproxy"
+	socks.Password = "secret"
+	defer socks.Close()
+	socks.AddOnion(onionHost, pathHandler())
+
+	p, err := torproxytest.NewProxy(socks, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if status, _ := get(t, http.DefaultClient, p.URL+route+"/"); status != http.StatusOK {
+		t.Fatalf("got status %d with the right credentials, want %d", status, http.StatusOK)
+	}
+
+	client := socks.TorClient()
+	client.Password = "wrong"
+	pool, err := torproxy.NewPool([]*torproxy.TorClient{client}, torproxy.RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	// without health checks, the failing backends are kept in rotation
+	pool.WithHealthCheck(time.Hour)
+
+	tp := torproxy.NewTorProxyWithDialer(pool)
+	tp.Pool = pool
+	reg, err := torproxytest.RegistryFromEndpoints(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.WithRegistry(reg); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(tp.Handler())
+	defer srv.Close()
+
+	if status, _ := get(t, http.DefaultClient, srv.URL+route+"/"); status != http.StatusBadGateway {
+		t.Fatalf("got status %d with the wrong credentials, want %d", status, http.StatusBadGateway)
+	}
+	// a failed authentication is a failure of the tor client, not of the onion
+	if n := len(pool.Healthy()); n != 0 {
+		t.Fatalf("got %d healthy tor clients with the wrong credentials, want 0", n)
+	}
+}